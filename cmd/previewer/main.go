@@ -1,13 +1,18 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
-	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/dmitryt/image-previewer/internal/app"
 	"github.com/dmitryt/image-previewer/internal/config"
+	"github.com/dmitryt/image-previewer/internal/fetcher"
 	"github.com/dmitryt/image-previewer/internal/logger"
 	"github.com/rs/zerolog/log"
 )
@@ -16,6 +21,8 @@ var cfgPath string
 
 var ErrAppFatal = errors.New("application cannot start")
 
+const shutdownTimeout = 10 * time.Second
+
 func init() {
 	flag.StringVar(&cfgPath, "config", "", "Image previewer config")
 }
@@ -29,12 +36,27 @@ func main() {
 	}
 	logger.Init(cfg)
 	log.Debug().Msgf("Config Init %+v", cfg)
-	app, err := app.New(cfg, http.DefaultClient)
+	app, err := app.New(cfg, fetcher.NewHTTPClient(cfg))
 	if err != nil {
 		log.Fatal().Err(err).Msgf("%s", ErrAppFatal)
 	}
+	// Server is stopped before the shutdown is finished, so it's waited separately
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		<-signals
+		log.Info().Msg("Shutting down...")
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := app.Shutdown(ctx); err != nil {
+			log.Error().Err(err).Msg("shutdown error")
+		}
+	}()
 	err = app.Run(fmt.Sprintf("%s:%d", cfg.Host, cfg.Port))
 	if err != nil {
 		log.Fatal().Err(err).Msgf("%s", ErrAppFatal)
 	}
+	<-stopped
 }
@@ -1,14 +1,17 @@
 package app
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
+	"sync"
 
 	"github.com/dmitryt/image-previewer/internal/config"
 	"github.com/dmitryt/image-previewer/internal/fetcher"
 	"github.com/dmitryt/image-previewer/internal/resizer"
+	"github.com/dmitryt/image-previewer/internal/signer"
 	"github.com/dmitryt/image-previewer/internal/transport"
 	"github.com/dmitryt/image-previewer/internal/utils"
 	"github.com/rs/zerolog/log"
@@ -19,12 +22,18 @@ var (
 	ErrImageResize        = errors.New("error during resizing the image")
 	ErrInvalidURI         = errors.New("invalid URI. Expected format is: /<method>/<width>/<height>/<external url>")
 	ErrImageCopyFromCache = errors.New("error during copying the image from cache")
+	ErrForbidden          = errors.New("access denied")
+	ErrPresetsOnly        = errors.New("only presets are allowed")
 )
 
 type App struct {
 	config    *config.Config
 	resizer   *resizer.Resizer
 	transport *transport.Transport
+	signer    *signer.Signer
+	presets   map[string]utils.URLParams
+	server    *http.Server
+	serverMux sync.Mutex
 }
 
 type DummyResponse struct {
@@ -32,13 +41,28 @@ type DummyResponse struct {
 }
 
 func New(config *config.Config, client *http.Client) (*App, error) {
+	presets, err := utils.ParsePresets(config.Presets)
+	if err != nil {
+		return nil, err
+	}
 	rsz, err := resizer.New(config)
+	if err == nil {
+		for name, up := range presets {
+			if err = rsz.Validate(up); err != nil {
+				err = fmt.Errorf("preset %s: %w", name, err)
+
+				break
+			}
+		}
+	}
 	transport := transport.New(fetcher.NewHTTPFetcher(client, config), rsz)
 
 	return &App{
 		config:    config,
 		resizer:   rsz,
 		transport: transport,
+		signer:    signer.New(config),
+		presets:   presets,
 	}, err
 }
 
@@ -57,41 +81,105 @@ func (p *App) HealthCheckHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (p *App) ResizeHandler(w http.ResponseWriter, r *http.Request) {
-	urlParams := utils.ParseURL("/" + r.URL.Path[1:])
+	// Query string is a part of the external url
+	path, err := p.signer.Verify(r.URL.RequestURI())
+	if err != nil {
+		log.Error().Msgf("%s: %s", ErrForbidden, err)
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "%s: %s", ErrForbidden, err)
+
+		return
+	}
+	if p.config.PresetsOnly && !utils.IsPresetURL(path) {
+		log.Error().Msgf("%s: %s", ErrForbidden, ErrPresetsOnly)
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "%s: %s", ErrForbidden, ErrPresetsOnly)
+
+		return
+	}
+	var urlParams utils.URLParams
+	if utils.IsPresetURL(path) {
+		urlParams = utils.ParsePresetURL(path, p.presets)
+	} else {
+		urlParams = utils.ParseURL(path)
+	}
 	log.Debug().Msgf("url params %+v", urlParams)
 	if urlParams.Error != nil {
 		log.Error().Msgf("%s: %+v", ErrInvalidURI, urlParams)
 		w.WriteHeader(400)
-		fmt.Fprintf(w, "%s", ErrInvalidURI)
+		fmt.Fprintf(w, "%s: %s", ErrInvalidURI, urlParams.Error)
 
 		return
 	}
-	if !p.resizer.HasFile(urlParams) {
-		log.Debug().Msg("File was not found in cache, fetching the content...")
-		statusCode, content, err := p.transport.Receive(urlParams, r.Header)
-		if err != nil {
-			log.Error().Msgf("%s: %s", ErrImageFetch, err)
-			w.WriteHeader(statusCode)
-			fmt.Fprint(w, content)
+	if err = p.resizer.Validate(urlParams); err != nil {
+		log.Error().Msgf("%s: %s", ErrInvalidURI, err)
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "%s: %s", ErrInvalidURI, err)
 
-			return
-		}
+		return
+	}
+	if urlParams.Format == "" {
+		// Output format depends on the client, if it's not set explicitly
+		urlParams.AcceptFormat = utils.NegotiateFormat(r.Header.Get("Accept"))
+		w.Header().Set("Vary", "Accept")
+	}
+	// File is taken from cache, if it's there
+	statusCode, content, err := p.transport.Receive(r.Context(), urlParams, r.Header)
+	if err != nil {
+		log.Error().Msgf("%s: %s", ErrImageFetch, err)
+		w.WriteHeader(statusCode)
+		fmt.Fprint(w, content)
+
+		return
 	}
 
-	err := p.transport.Send(urlParams, w)
+	err = p.transport.Send(urlParams, w)
 	if err != nil {
 		log.Error().Msgf("%s: %s", ErrImageCopyFromCache, err)
 		fmt.Fprintf(w, "%s", ErrImageCopyFromCache)
 	}
 }
 
-func (p *App) Run(addr string) error {
-	mux := http.NewServeMux()
+// Handler routes the requests. ServeMux isn't used, as it cleans the path and redirects
+// the URLs with external urls like /fill/100/100/https://..., which breaks signatures.
+func (p *App) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health-check" {
+			p.HealthCheckHandler(w, r)
 
-	mux.HandleFunc("/health-check", p.HealthCheckHandler)
-	mux.HandleFunc("/fill/", p.ResizeHandler)
+			return
+		}
+		// Signature can be the first part of the path, so all other paths are handled by resizer
+		p.ResizeHandler(w, r)
+	})
+}
 
+func (p *App) Run(addr string) error {
 	log.Info().Msgf("Listening at %s", addr)
+	p.serverMux.Lock()
+	p.server = &http.Server{Addr: addr, Handler: p.Handler()}
+	p.serverMux.Unlock()
+	err := p.server.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+
+	return err
+}
+
+// Shutdown stops the server gracefully and saves the state of the cache.
+func (p *App) Shutdown(ctx context.Context) error {
+	var err error
+	p.serverMux.Lock()
+	server := p.server
+	p.serverMux.Unlock()
+	if server != nil {
+		err = server.Shutdown(ctx)
+	}
+	errClose := p.resizer.Close()
+	if err == nil {
+		err = errClose
+	}
 
-	return http.ListenAndServe(addr, mux)
+	return err
 }
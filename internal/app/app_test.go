@@ -2,15 +2,26 @@ package app
 
 import (
 	"context"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	_ "image/jpeg"
+	_ "image/png"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
+	_ "github.com/chai2010/webp"
 	"github.com/dmitryt/image-previewer/internal/config"
+	"github.com/dmitryt/image-previewer/internal/fetcher"
+	"github.com/dmitryt/image-previewer/internal/signer"
 	"github.com/dmitryt/image-previewer/internal/utils"
 	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/require"
@@ -33,17 +44,34 @@ func teardown() {
 	os.RemoveAll(cacheDir)
 }
 
-func prepareHandlers(t *testing.T, cfg *config.Config, client *http.Client) (*App, *http.ServeMux) {
+// Starts the app, which fetches the images from the external server by the client. The external server serves
+// the sample image and the client of the external server is used, if they are nil. Returns the app, its server
+// and the URL of the image on the external server, plain http URLs are returned without the scheme.
+func newTestServers(
+	t *testing.T, cfg *config.Config, external *httptest.Server, client *http.Client,
+) (*App, *httptest.Server, string) {
+	t.Helper()
+	if external == nil {
+		external = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.ServeFile(w, r, "testdata/sample.jpg")
+		}))
+	}
+	t.Cleanup(external.Close)
+	if client == nil {
+		client = external.Client()
+	}
+	cfg.CacheDir = cacheDir
 	app, err := New(cfg, client)
 	require.NoError(t, err)
-	r := http.NewServeMux()
-	r.HandleFunc("/fill/", app.ResizeHandler)
+	srv := httptest.NewServer(app.Handler())
+	t.Cleanup(srv.Close)
 
-	return app, r
+	return app, srv, strings.TrimPrefix(external.URL, "http://") + "/some/file/path.jpg"
 }
 
 func checkFileInDir(t *testing.T, fileName string, expected bool) {
-	_, err := os.Stat(filepath.Join(cacheDir, fileName))
+	// Files are placed in the nested dirs by the first chars of the name
+	_, err := os.Stat(filepath.Join(cacheDir, fileName[0:2], fileName[2:4], fileName))
 	if expected {
 		require.NoError(t, err)
 	} else {
@@ -66,18 +94,9 @@ func makeRequest(t *testing.T, client *http.Client, host, url string) *http.Resp
 
 func TestResizeCacheHandler(t *testing.T) {
 	cfg := config.GetDefaultConfig()
-	cfg.CacheDir = cacheDir
-	externalServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		http.ServeFile(w, r, "testdata/sample.jpg")
-	}))
-	defer externalServer.Close()
-
-	externalURL := fmt.Sprintf("%s/some/file/path.jpg", strings.Replace(externalServer.URL, "http://", "", -1))
-
-	client := externalServer.Client()
-	app, mux := prepareHandlers(t, cfg, client)
-	srv := httptest.NewServer(mux)
-	defer srv.Close()
+	cfg.CacheSize = 10
+	app, srv, externalURL := newTestServers(t, cfg, nil, nil)
+	client := srv.Client()
 
 	cacheSize := cfg.CacheSize
 
@@ -86,7 +105,7 @@ func TestResizeCacheHandler(t *testing.T) {
 
 	for i := 0; i <= cacheSize; i++ {
 		url := fmt.Sprintf(urlTemplate, baseHeight+i, externalURL)
-		up := utils.URLParams{ExternalURL: externalURL, Width: 100, Height: baseHeight + i}
+		up := utils.URLParams{Method: "fill", ExternalURL: externalURL, Width: 100, Height: baseHeight + i}
 		res := makeRequest(t, client, srv.URL, url)
 		defer res.Body.Close()
 
@@ -98,7 +117,332 @@ func TestResizeCacheHandler(t *testing.T) {
 	}
 
 	// Check first item. File shouldn't exist in cache folder
-	up := utils.URLParams{ExternalURL: externalURL, Width: 100, Height: baseHeight}
+	up := utils.URLParams{Method: "fill", ExternalURL: externalURL, Width: 100, Height: baseHeight}
 	cacheKey := app.resizer.GetCacheKey(up)
 	checkFileInDir(t, string(cacheKey), false)
 }
+
+func TestResizeMethodsHandler(t *testing.T) {
+	cfg := config.GetDefaultConfig()
+	app, srv, externalURL := newTestServers(t, cfg, nil, nil)
+	client := srv.Client()
+
+	tests := []struct {
+		method string
+		size   string
+		width  int
+		height int
+	}{
+		{method: "fill", size: "100/100", width: 100, height: 100},
+		{method: "fit", size: "100/100", width: 100, height: 49},
+		{method: "resize", size: "100/100", width: 100, height: 100},
+		{method: "fill", size: "512/0", width: 512, height: 252},
+		{method: "resize", size: "0/126", width: 256, height: 126},
+	}
+
+	for _, tc := range tests {
+		res := makeRequest(t, client, srv.URL, fmt.Sprintf("/%s/%s/%s", tc.method, tc.size, externalURL))
+		defer res.Body.Close()
+		require.Equal(t, http.StatusOK, res.StatusCode, "incorrect status code")
+
+		img, _, err := image.Decode(res.Body)
+		require.NoError(t, err)
+		require.Equal(t, tc.width, img.Bounds().Dx(), "incorrect width for %s", tc.method)
+		require.Equal(t, tc.height, img.Bounds().Dy(), "incorrect height for %s", tc.method)
+	}
+
+	fillKey := app.resizer.GetCacheKey(utils.URLParams{Method: "fill", ExternalURL: externalURL, Width: 100, Height: 100})
+	fitKey := app.resizer.GetCacheKey(utils.URLParams{Method: "fit", ExternalURL: externalURL, Width: 100, Height: 100})
+	require.NotEqual(t, fillKey, fitKey)
+	checkFileInDir(t, string(fillKey), true)
+	checkFileInDir(t, string(fitKey), true)
+}
+
+func TestZeroDimensionsHandler(t *testing.T) {
+	cfg := config.GetDefaultConfig()
+	_, srv, _ := newTestServers(t, cfg, nil, http.DefaultClient)
+
+	res := makeRequest(t, srv.Client(), srv.URL, "/resize/0/0/example.com/image.jpg")
+	defer res.Body.Close()
+	require.Equal(t, http.StatusBadRequest, res.StatusCode, "incorrect status code")
+}
+
+func TestOptionRangeHandler(t *testing.T) {
+	cfg := config.GetDefaultConfig()
+	cfg.MinQuality = 30
+	cfg.MaxQuality = 90
+	cfg.MinCompression = 3
+	_, srv, _ := newTestServers(t, cfg, nil, http.DefaultClient)
+
+	for _, url := range []string{
+		"/fill/100/100/quality:20/example.com/image.jpg",
+		"/fill/100/100/quality:95/example.com/image.jpg",
+		"/fill/100/100/compression:1/example.com/image.png",
+	} {
+		res := makeRequest(t, srv.Client(), srv.URL, url)
+		defer res.Body.Close()
+		require.Equal(t, http.StatusBadRequest, res.StatusCode, "incorrect status code for %s", url)
+	}
+
+	t.Run("should fail, if preset is out of range", func(t *testing.T) {
+		cfg := config.GetDefaultConfig()
+		cfg.CacheDir = cacheDir
+		cfg.MaxQuality = 90
+		cfg.Presets = map[string]string{"hq": "fit 100x100 q=95"}
+		_, err := New(cfg, http.DefaultClient)
+		require.Error(t, err)
+	})
+}
+
+func TestFormatConversionHandler(t *testing.T) {
+	cfg := config.GetDefaultConfig()
+	_, srv, externalURL := newTestServers(t, cfg, nil, nil)
+	client := srv.Client()
+
+	for format, contentType := range map[string]string{
+		"png":  "image/png",
+		"gif":  "image/gif",
+		"jpg":  "image/jpeg",
+		"webp": "image/webp",
+	} {
+		res := makeRequest(t, client, srv.URL, fmt.Sprintf("/fill/100/100/format:%s/%s", format, externalURL))
+		defer res.Body.Close()
+		require.Equal(t, http.StatusOK, res.StatusCode, "incorrect status code")
+		require.Equal(t, []string{contentType}, res.Header["Content-Type"], "incorrect Content-Type")
+
+		_, decodedFormat, err := image.Decode(res.Body)
+		require.NoError(t, err)
+		require.Equal(t, strings.TrimPrefix(contentType, "image/"), decodedFormat)
+	}
+}
+
+func TestFormatNegotiationHandler(t *testing.T) {
+	cfg := config.GetDefaultConfig()
+	app, srv, externalURL := newTestServers(t, cfg, nil, nil)
+	client := srv.Client()
+
+	tests := []struct {
+		accept      string
+		format      string
+		contentType string
+	}{
+		{accept: "image/avif,image/webp,*/*", format: "webp", contentType: "image/webp"},
+		{accept: "image/png,*/*", format: "", contentType: "image/jpeg"},
+	}
+
+	for _, tc := range tests {
+		req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, srv.URL+"/fill/100/100/"+externalURL, nil)
+		require.NoError(t, err)
+		req.Header.Set("Accept", tc.accept)
+		res, err := client.Do(req)
+		require.NoError(t, err)
+		defer res.Body.Close()
+
+		require.Equal(t, http.StatusOK, res.StatusCode, "incorrect status code")
+		require.Equal(t, []string{tc.contentType}, res.Header["Content-Type"], "incorrect Content-Type")
+		require.Equal(t, "Accept", res.Header.Get("Vary"))
+
+		up := utils.URLParams{Method: "fill", ExternalURL: externalURL, Width: 100, Height: 100, AcceptFormat: tc.format}
+		checkFileInDir(t, string(app.resizer.GetCacheKey(up)), true)
+	}
+}
+
+func TestAnimationNegotiationHandler(t *testing.T) {
+	cfg := config.GetDefaultConfig()
+	palette := color.Palette{color.Black, color.White}
+	src := &gif.GIF{}
+	for i := 0; i < 3; i++ {
+		frame := image.NewPaletted(image.Rect(0, 0, 200, 100), palette)
+		for j := range frame.Pix {
+			frame.Pix[j] = uint8(i % 2)
+		}
+		src.Image = append(src.Image, frame)
+		src.Delay = append(src.Delay, 10)
+	}
+	externalServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/gif")
+		_ = gif.EncodeAll(w, src)
+	}))
+	_, srv, externalURL := newTestServers(t, cfg, externalServer, nil)
+	client := srv.Client()
+
+	t.Run("should keep animation, if webp is accepted", func(t *testing.T) {
+		req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, srv.URL+"/fit/100/100/"+externalURL, nil)
+		require.NoError(t, err)
+		req.Header.Set("Accept", "image/webp,*/*")
+		res, err := client.Do(req)
+		require.NoError(t, err)
+		defer res.Body.Close()
+
+		require.Equal(t, http.StatusOK, res.StatusCode, "incorrect status code")
+		require.Equal(t, []string{"image/gif"}, res.Header["Content-Type"], "incorrect Content-Type")
+		result, err := gif.DecodeAll(res.Body)
+		require.NoError(t, err)
+		require.Len(t, result.Image, 3)
+	})
+
+	t.Run("should convert the first frame to webp", func(t *testing.T) {
+		req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, srv.URL+"/fit/100/100/frame:first/"+externalURL, nil)
+		require.NoError(t, err)
+		req.Header.Set("Accept", "image/webp,*/*")
+		res, err := client.Do(req)
+		require.NoError(t, err)
+		defer res.Body.Close()
+
+		require.Equal(t, http.StatusOK, res.StatusCode, "incorrect status code")
+		require.Equal(t, []string{"image/webp"}, res.Header["Content-Type"], "incorrect Content-Type")
+	})
+}
+
+func TestSignedURLHandler(t *testing.T) {
+	cfg := config.GetDefaultConfig()
+	cfg.SignatureKeys = []string{"secret"}
+	_, srv, externalURL := newTestServers(t, cfg, nil, nil)
+	client := srv.Client()
+
+	path := "/fill/120/80/" + externalURL
+	tests := map[string]int{
+		"/" + signer.Sign("secret", path) + path: http.StatusOK,
+		"/" + signer.Sign("wrong", path) + path:  http.StatusForbidden,
+		"/unsafe" + path:                         http.StatusForbidden,
+		path:                                     http.StatusForbidden,
+	}
+	for url, statusCode := range tests {
+		res := makeRequest(t, client, srv.URL, url)
+		defer res.Body.Close()
+		require.Equal(t, statusCode, res.StatusCode, "incorrect status code for %s", url)
+	}
+}
+
+func TestSignedHTTPSExternalURLHandler(t *testing.T) {
+	cfg := config.GetDefaultConfig()
+	cfg.SignatureKeys = []string{"secret"}
+	externalServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, "testdata/sample.jpg")
+	}))
+	_, srv, externalURL := newTestServers(t, cfg, externalServer, nil)
+
+	// Redirects are not followed, so the path is checked as it is
+	client := srv.Client()
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	path := "/fill/120/80/" + externalURL
+	res := makeRequest(t, client, srv.URL, "/"+signer.Sign("secret", path)+path)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode, "incorrect status code")
+	require.Equal(t, []string{"image/jpeg"}, res.Header["Content-Type"], "incorrect Content-Type")
+}
+
+func TestPresetHandler(t *testing.T) {
+	cfg := config.GetDefaultConfig()
+	cfg.Presets = map[string]string{"thumb": "fit 150x150 q=70"}
+	cfg.PresetsOnly = true
+	app, srv, externalURL := newTestServers(t, cfg, nil, nil)
+	client := srv.Client()
+
+	res := makeRequest(t, client, srv.URL, "/preset/thumb/"+externalURL)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode, "incorrect status code")
+	img, _, err := image.Decode(res.Body)
+	require.NoError(t, err)
+	require.Equal(t, image.Rect(0, 0, 150, 73), img.Bounds())
+
+	// Preset is the same as the raw URL, so they share the cache
+	up := utils.URLParams{Method: "fit", ExternalURL: externalURL, Width: 150, Height: 150, Quality: 70}
+	checkFileInDir(t, string(app.resizer.GetCacheKey(up)), true)
+
+	for url, statusCode := range map[string]int{
+		"/preset/banner/" + externalURL:          http.StatusBadRequest,
+		"/fit/150/150/quality:70/" + externalURL: http.StatusForbidden,
+	} {
+		res := makeRequest(t, client, srv.URL, url)
+		defer res.Body.Close()
+		require.Equal(t, statusCode, res.StatusCode, "incorrect status code for %s", url)
+	}
+}
+
+func TestInvalidPreset(t *testing.T) {
+	cfg := config.GetDefaultConfig()
+	cfg.CacheDir = cacheDir
+	cfg.Presets = map[string]string{"thumb": "fit 150"}
+	_, err := New(cfg, http.DefaultClient)
+	require.True(t, errors.Is(err, utils.ErrInvalidPreset))
+}
+
+func TestHTTPSExternalURLHandler(t *testing.T) {
+	cfg := config.GetDefaultConfig()
+	externalServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("token") != "abc" {
+			w.WriteHeader(http.StatusNotFound)
+
+			return
+		}
+		http.ServeFile(w, r, "testdata/sample.jpg")
+	}))
+	_, srv, externalURL := newTestServers(t, cfg, externalServer, nil)
+	client := srv.Client()
+
+	externalURL += "?token=abc"
+	for url, statusCode := range map[string]int{
+		"/fill/100/100/" + externalURL: http.StatusOK,
+		"/fill/100/100/b64:" + base64.RawURLEncoding.EncodeToString([]byte(externalURL)): http.StatusOK,
+		"/fill/100/100/" + strings.TrimSuffix(externalURL, "abc"):                        http.StatusNotFound,
+	} {
+		res := makeRequest(t, client, srv.URL, url)
+		defer res.Body.Close()
+		require.Equal(t, statusCode, res.StatusCode, "incorrect status code for %s", url)
+	}
+}
+
+func TestForbiddenExternalHostHandler(t *testing.T) {
+	t.Run("should refuse to connect to private addresses", func(t *testing.T) {
+		cfg := config.GetDefaultConfig()
+		_, srv, externalURL := newTestServers(t, cfg, nil, fetcher.NewHTTPClient(cfg))
+
+		for _, url := range []string{externalURL, "localhost" + externalURL[strings.Index(externalURL, ":"):]} {
+			res := makeRequest(t, srv.Client(), srv.URL, "/fill/100/100/"+url)
+			defer res.Body.Close()
+			require.Equal(t, http.StatusForbidden, res.StatusCode, "incorrect status code for %s", url)
+		}
+	})
+
+	t.Run("should check allowed and denied hosts", func(t *testing.T) {
+		cfg := config.GetDefaultConfig()
+		cfg.CacheDir = cacheDir
+		cfg.AllowPrivateNetworks = true
+		cfg.AllowedHosts = []string{"127.0.0.1", "*.example.com"}
+		cfg.DeniedHosts = []string{"private.example.com"}
+		_, srv, externalURL := newTestServers(t, cfg, nil, fetcher.NewHTTPClient(cfg))
+
+		for url, statusCode := range map[string]int{
+			externalURL:                    http.StatusOK,
+			"private.example.com/path.jpg": http.StatusForbidden,
+			"example.org/path.jpg":         http.StatusForbidden,
+		} {
+			res := makeRequest(t, srv.Client(), srv.URL, "/fill/100/100/"+url)
+			defer res.Body.Close()
+			require.Equal(t, statusCode, res.StatusCode, "incorrect status code for %s", url)
+		}
+	})
+}
+
+func TestTimeoutHandler(t *testing.T) {
+	release := make(chan struct{})
+	externalServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+		http.ServeFile(w, r, "testdata/sample.jpg")
+	}))
+	defer close(release)
+
+	cfg := config.GetDefaultConfig()
+	cfg.AllowPrivateNetworks = true
+	cfg.FetchTimeout = 100 * time.Millisecond
+	_, srv, externalURL := newTestServers(t, cfg, externalServer, fetcher.NewHTTPClient(cfg))
+	res := makeRequest(t, srv.Client(), srv.URL, "/fill/100/100/"+externalURL)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusGatewayTimeout, res.StatusCode)
+}
@@ -0,0 +1,82 @@
+package cache
+
+import (
+	"errors"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeEntry(t *testing.T, c Cache, key Key, data string) {
+	w, err := c.Create(key, "image/png")
+	require.NoError(t, err)
+	_, err = w.Write([]byte(data))
+	require.NoError(t, err)
+	require.NoError(t, w.Commit())
+	// Abort after Commit doesn't discard the entry
+	w.Abort()
+}
+
+func readEntry(t *testing.T, c Cache, key Key) (string, Meta) {
+	content, meta, err := c.Open(key)
+	require.NoError(t, err)
+	defer content.Close()
+	data, err := ioutil.ReadAll(content)
+	require.NoError(t, err)
+
+	return string(data), meta
+}
+
+// All backends should behave the same way.
+func testBackend(t *testing.T, c Cache) {
+	t.Run("missing entry", func(t *testing.T) {
+		require.False(t, c.Has("aaa"))
+		_, _, err := c.Open("aaa")
+		require.True(t, errors.Is(err, ErrNotFound))
+	})
+
+	t.Run("committed entry", func(t *testing.T) {
+		// PNG signature, so content type is detected by file backend as well
+		data := "\x89PNG\r\n\x1a\ncontent"
+		writeEntry(t, c, "bbb", data)
+
+		require.True(t, c.Has("bbb"))
+		result, meta := readEntry(t, c, "bbb")
+		require.Equal(t, data, result)
+		require.Equal(t, Meta{ContentType: "image/png", Size: int64(len(data))}, meta)
+
+		writeEntry(t, c, "bbb", data+"new")
+		result, _ = readEntry(t, c, "bbb")
+		require.Equal(t, data+"new", result)
+	})
+
+	t.Run("aborted entry", func(t *testing.T) {
+		w, err := c.Create("ccc", "image/png")
+		require.NoError(t, err)
+		_, err = w.Write([]byte("partial"))
+		require.NoError(t, err)
+		require.False(t, c.Has("ccc"))
+		w.Abort()
+
+		require.False(t, c.Has("ccc"))
+		_, err = w.Write([]byte("partial"))
+		require.Error(t, err)
+	})
+
+	t.Run("clear", func(t *testing.T) {
+		writeEntry(t, c, "ddd", "content")
+		c.Clear()
+		require.False(t, c.Has("bbb"))
+		require.False(t, c.Has("ddd"))
+	})
+}
+
+func TestFileBackend(t *testing.T) {
+	c, err := New(cacheDir, Options{})
+	require.NoError(t, err)
+	defer c.Close()
+	defer c.Clear()
+
+	testBackend(t, c)
+}
@@ -0,0 +1,51 @@
+package cache
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+)
+
+var ErrWriterClosed = errors.New("cache writer is already closed")
+
+// bufferWriter keeps the content in memory and passes it to the commit function at once,
+// so the shared stores never have the partially written entries.
+type bufferWriter struct {
+	commit func(data []byte) error
+	buf    bytes.Buffer
+	done   bool
+	// Writing can be aborted from another goroutine, e.g. on timeout
+	mux sync.Mutex
+}
+
+func newBufferWriter(commit func(data []byte) error) *bufferWriter {
+	return &bufferWriter{commit: commit}
+}
+
+func (w *bufferWriter) Write(p []byte) (int, error) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	if w.done {
+		return 0, ErrWriterClosed
+	}
+
+	return w.buf.Write(p)
+}
+
+func (w *bufferWriter) Commit() error {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	if w.done {
+		return ErrWriterClosed
+	}
+	w.done = true
+
+	return w.commit(w.buf.Bytes())
+}
+
+func (w *bufferWriter) Abort() {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	w.done = true
+	w.buf.Reset()
+}
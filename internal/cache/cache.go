@@ -2,44 +2,137 @@ package cache
 
 import (
 	"errors"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/dmitryt/image-previewer/internal/utils"
 	"github.com/rs/zerolog/log"
 )
 
-var ErrIncorrectFilePath = errors.New("incorrect file path")
+var (
+	ErrIncorrectFilePath = errors.New("incorrect file path")
+	ErrNotFound          = errors.New("cache entry is not found")
+)
+
+// Files are written to the temp files first and renamed, when they are ready.
+// Dot prefix hides them from the cache on startup.
+const tempFilePrefix = ".tmp-"
+
+// Count of nested dirs, each of them is named by the next 2 chars of the key.
+const shardDirLevels = 2
+
+// Min share of the capacity for each shard, the count of shards is reduced for the small capacity.
+const minShardItems = 8
 
 type Key string
 
+// Cache stores the resized images. Entries are written via Writer and become visible only
+// after they are committed, so partially written entries are never read.
 type Cache interface {
-	Set(key Key, value interface{}) (bool, error)
-	Get(key Key) (interface{}, bool)
-	GetDir() string
-	GetFile(key Key, flag int) (*os.File, error)
-	GetFilePath(key Key) string
-	HasFilePath(key Key) bool
+	// Has checks, whether the entry exists and isn't expired. It marks the entry as recently used.
+	Has(key Key) bool
+	Open(key Key) (io.ReadCloser, Meta, error)
+	Create(key Key, contentType string) (Writer, error)
 	Clear()
+	Close() error
+}
+
+// Meta is the information about the cache entry.
+type Meta struct {
+	ContentType string
+	Size        int64
+}
+
+type Writer interface {
+	io.Writer
+	// Commit makes the written content available in cache
+	Commit() error
+	// Abort discards the written content, it can be called after Commit as well
+	Abort()
+}
+
+type Options struct {
+	// Limits of the items count and the total size of files in bytes, zero means no limit
+	Capacity int
+	MaxBytes int64
+	// How often the LRU order is saved to disk, zero means it's saved only on Close
+	IndexInterval time.Duration
+	// Max age of cached files, zero means they don't expire. Expired files are removed every SweepInterval
+	TTL           time.Duration
+	SweepInterval time.Duration
+	// LRU is split into shards with separate locks, the limits are shared by all of them.
+	// Items are evicted from the shard of the added one, so LRU order is approximate for the whole cache.
+	// The count is reduced, so each shard gets at least minShardItems of the capacity
+	Shards int
 }
 
 type lruCache struct {
-	dir      string
+	// Count of items and total size of files in all shards, they are changed atomically
+	// under the lock of the changed shard
+	count    int64
+	size     int64
 	capacity int
-	queue    List
-	items    map[Key]*listItem
-	mux      sync.Mutex
+	maxBytes int64
+	dir      string
+	ttl      time.Duration
+	shards   []*shard
+	done     chan struct{}
+	closed   sync.Once
 }
 
 type cacheItem struct {
-	key   Key
-	value interface{}
+	key      Key
+	value    interface{}
+	size     int64
+	accessed time.Time
+	// Zero time means the item doesn't expire
+	expires time.Time
+}
+
+func (ci cacheItem) isExpired(now time.Time) bool {
+	return !ci.expires.IsZero() && !now.Before(ci.expires)
+}
+
+// New creates the cache, which keeps the files in the given dir.
+func New(dir string, options Options) (Cache, error) {
+	return newLRUCache(dir, options)
 }
 
-func New(capacity int, dir string) (Cache, error) {
-	cache := &lruCache{capacity: capacity, dir: dir, queue: NewList(), items: make(map[Key]*listItem)}
+func newLRUCache(dir string, options Options) (*lruCache, error) {
+	count := options.Shards
+	// Items are evicted from the shard of the added one, so each shard should have the share of the capacity
+	if options.Capacity > 0 && count > options.Capacity/minShardItems {
+		count = options.Capacity / minShardItems
+	}
+	if count < 1 {
+		count = 1
+	}
+	cache := &lruCache{
+		capacity: options.Capacity,
+		maxBytes: options.MaxBytes,
+		ttl:      options.TTL,
+		dir:      dir,
+		shards:   make([]*shard, count),
+		done:     make(chan struct{}),
+	}
+	for i := range cache.shards {
+		cache.shards[i] = newShard(cache)
+	}
 	err := cache.Init()
+	if err == nil && options.IndexInterval > 0 {
+		go cache.saveIndexPeriodically(options.IndexInterval)
+	}
+	if err == nil && options.TTL > 0 && options.SweepInterval > 0 {
+		go cache.sweepPeriodically(options.SweepInterval)
+	}
 
 	return cache, err
 }
@@ -54,81 +147,250 @@ func (c *lruCache) Init() error {
 	if err != nil {
 		return err
 	}
+	index, err := readIndex(c.indexPath())
+	if err != nil {
+		log.Error().Msgf("reading cache index error %s", err)
+	}
 
-	return filepath.Walk(c.dir, func(path string, info os.FileInfo, err error) error {
+	var items []cacheItem
+	// Files of the previous flat layout are moved to the nested dirs after walking the tree,
+	// so they are not visited twice
+	moved := make(map[string]string)
+	err = filepath.Walk(c.dir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
-		if !info.IsDir() && !strings.HasPrefix(filepath.Base(path), ".") {
-			_, err = c.Set(Key(filepath.Base(path)), filepath.Base(path))
-			if err != nil {
-				return err
+		name := filepath.Base(path)
+		// Partial files are left, if the process was stopped during writing them
+		if !info.IsDir() && (strings.HasPrefix(name, tempFilePrefix) || (info.Size() == 0 && !strings.HasPrefix(name, "."))) {
+			log.Debug().Msgf("removing partial file %s", path)
+
+			return os.Remove(path)
+		}
+		if !info.IsDir() && !strings.HasPrefix(name, ".") {
+			key := Key(name)
+			if path != c.GetFilePath(key) {
+				moved[path] = c.GetFilePath(key)
+			}
+			// Files, which are not in the index, were written after it was saved
+			entry, ok := index[key]
+			if !ok {
+				entry = indexEntry{accessed: info.ModTime(), expires: c.expiresAt(info.ModTime())}
 			}
+			items = append(items, cacheItem{key: key, value: name, accessed: entry.accessed, expires: entry.expires})
 		}
 
 		return nil
 	})
+	if err != nil {
+		return err
+	}
+	for from, to := range moved {
+		log.Debug().Msgf("moving cache file %s to %s", from, to)
+		if err = c.moveFile(from, to); err != nil {
+			return err
+		}
+	}
+	// The most recently used items are added last, so they are at the front of the queue
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].accessed.Before(items[j].accessed)
+	})
+	for _, item := range items {
+		s := c.shard(item.key)
+		_, err = s.set(item)
+		if err == nil {
+			err = c.evict(s, item.key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
+// Files are placed in the nested dirs by the first chars of the key, e.g. ab/cd/abcd..., so there are
+// not too many files in the single dir. Short keys are placed in the root dir.
 func (c *lruCache) GetFilePath(key Key) string {
-	return filepath.Join(c.GetDir(), string(key))
+	if len(key) < 2*shardDirLevels {
+		return filepath.Join(c.dir, string(key))
+	}
+	parts := make([]string, 0, shardDirLevels+2)
+	parts = append(parts, c.dir)
+	for i := 0; i < shardDirLevels; i++ {
+		parts = append(parts, string(key[2*i:2*i+2]))
+	}
+
+	return filepath.Join(append(parts, string(key))...)
+}
+
+// Moves the file, creating the dir if it's needed.
+func (c *lruCache) moveFile(from, to string) error {
+	err := os.MkdirAll(filepath.Dir(to), 0o755)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(from, to)
 }
 
 func (c *lruCache) HasFilePath(key Key) bool {
-	filePath := filepath.Join(filepath.Join(c.GetDir(), string(key)))
-	if _, err := os.Stat(filePath); err == nil {
+	if _, err := os.Stat(c.GetFilePath(key)); err == nil {
 		return true
 	}
 
 	return false
 }
 
-func (c *lruCache) GetFile(key Key, flag int) (*os.File, error) {
+// Has doesn't check the file itself, because files are added to the cache only when they are written.
+func (c *lruCache) Has(key Key) bool {
+	_, found := c.Get(key)
+
+	return found
+}
+
+// Open returns the cache file, content type is detected by its content.
+func (c *lruCache) Open(key Key) (io.ReadCloser, Meta, error) {
 	fpath := c.GetFilePath(key)
 	log.Debug().Msgf("Getting cache file %s", fpath)
+	f, err := os.Open(fpath)
+	if os.IsNotExist(err) {
+		return nil, Meta{}, ErrNotFound
+	}
+	if err != nil {
+		return nil, Meta{}, err
+	}
+	fileInfo, err := f.Stat()
+	if err != nil {
+		f.Close()
 
-	return os.OpenFile(fpath, flag, os.ModeAppend)
-}
+		return nil, Meta{}, err
+	}
+	contentType, err := utils.GetFileMimeType(f)
+	if err != nil {
+		f.Close()
 
-func (c *lruCache) Get(key Key) (interface{}, bool) {
-	c.mux.Lock()
-	defer c.mux.Unlock()
-	item, found := c.items[key]
-	if !found {
-		return nil, false
+		return nil, Meta{}, err
 	}
-	c.queue.MoveToFront(item)
 
-	return item.Value.(cacheItem).value, true
+	return f, Meta{ContentType: contentType, Size: fileInfo.Size()}, nil
 }
 
-func (c *lruCache) AddFile(fpath string) (err error) {
-	log.Debug().Msgf("creating file %s", fpath)
-	f, err := os.Create(fpath)
+type fileWriter struct {
+	*os.File
+	cache *lruCache
+	key   Key
+	done  bool
+}
+
+func (w *fileWriter) Commit() error {
+	w.done = true
+	err := w.File.Close()
 	if err != nil {
+		os.Remove(w.Name())
+
 		return err
 	}
-	log.Debug().Msgf("created file %s", fpath)
-	defer f.Close()
 
-	return nil
+	return w.cache.Commit(w.key, w.Name())
 }
 
-func (c *lruCache) RemoveFile(fpath string) (err error) {
-	log.Debug().Msgf("removing file %s", fpath)
-	err = os.Remove(filepath.Join(c.dir, fpath))
+func (w *fileWriter) Abort() {
+	if w.done {
+		return
+	}
+	w.done = true
+	w.File.Close()
+	os.Remove(w.Name())
+}
+
+// Create returns the writer of the temp file, which is moved to the cache on Commit.
+func (c *lruCache) Create(key Key, contentType string) (Writer, error) {
+	f, err := c.TempFile(key)
 	if err != nil {
+		return nil, err
+	}
+
+	return &fileWriter{File: f, cache: c, key: key}, nil
+}
+
+// TempFile creates the file, which is moved to the cache by Commit, when it's completely written.
+func (c *lruCache) TempFile(key Key) (*os.File, error) {
+	return ioutil.TempFile(c.dir, tempFilePrefix+string(key)+"-")
+}
+
+// Commit moves the temp file into the place of the cache file and adds the key to the cache.
+func (c *lruCache) Commit(key Key, tempPath string) error {
+	now := time.Now()
+	s := c.shard(key)
+	_, err := s.commit(tempPath, cacheItem{key: key, value: string(key), accessed: now, expires: c.expiresAt(now)})
+	if err != nil {
+		os.Remove(tempPath)
+
 		return err
 	}
-	log.Debug().Msgf("removed file %s", fpath)
 
-	return nil
+	return c.evict(s, key)
 }
 
-func (c *lruCache) processAddFile(fpath string) error {
-	if _, err := os.Stat(filepath.Join(c.dir, fpath)); os.IsNotExist(err) {
-		err = c.AddFile(filepath.Join(c.dir, fpath))
-		if err != nil {
+// Returns the shard of the key, the same key always gets the same shard.
+func (c *lruCache) shard(key Key) *shard {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+
+	return c.shards[h.Sum32()%uint32(len(c.shards))]
+}
+
+func (c *lruCache) Get(key Key) (interface{}, bool) {
+	return c.shard(key).get(key, time.Now())
+}
+
+// Set adds the key of the existing cache file, it fails with ErrNotFound, if the file is missing.
+func (c *lruCache) Set(key Key, value interface{}) (found bool, err error) {
+	now := time.Now()
+	s := c.shard(key)
+	found, err = s.set(cacheItem{key: key, value: value, accessed: now, expires: c.expiresAt(now)})
+	if err != nil {
+		return
+	}
+
+	return found, c.evict(s, key)
+}
+
+// Len returns the count of items in all shards.
+func (c *lruCache) Len() int {
+	return int(atomic.LoadInt64(&c.count))
+}
+
+// Size returns the total size of files in all shards.
+func (c *lruCache) Size() int64 {
+	return atomic.LoadInt64(&c.size)
+}
+
+// Checks, whether the cache exceeds any of the limits. The last added item is never evicted,
+// even if it's bigger than the whole budget.
+func (c *lruCache) isOverflowed() bool {
+	count := c.Len()
+	if count <= 1 {
+		return false
+	}
+
+	return (c.capacity > 0 && count > c.capacity) || (c.maxBytes > 0 && c.Size() > c.maxBytes)
+}
+
+// Removes the least recently used items of the shard, where the key was added, until the cache is under
+// the limits. The limits are global, but only the shard of the key is locked, so inserts to other shards
+// don't wait for it. LRU order is kept within each shard and is approximate for the whole cache.
+func (c *lruCache) evict(s *shard, added Key) error {
+	for c.isOverflowed() {
+		evicted, err := s.evictOldest(added)
+		// The shard has nothing to evict but the added key, then other shards are used one by one
+		for i := 0; err == nil && !evicted && i < len(c.shards); i++ {
+			if c.shards[i] != s {
+				evicted, err = c.shards[i].evictOldest(added)
+			}
+		}
+		if err != nil || !evicted {
 			return err
 		}
 	}
@@ -136,42 +398,45 @@ func (c *lruCache) processAddFile(fpath string) error {
 	return nil
 }
 
-func (c *lruCache) Set(key Key, value interface{}) (found bool, err error) {
-	c.mux.Lock()
-	defer c.mux.Unlock()
-	item, found := c.items[key]
-	if found {
-		c.queue.Remove(item)
-	} else {
-		fpath, ok := value.(string)
-		if !ok {
-			return found, ErrIncorrectFilePath
-		}
-		err = c.processAddFile(fpath)
-		if err != nil {
-			return found, err
-		}
+func (c *lruCache) RemoveFile(key Key) (err error) {
+	fpath := c.GetFilePath(key)
+	log.Debug().Msgf("removing file %s", fpath)
+	err = os.Remove(fpath)
+	if err != nil {
+		return err
 	}
-	c.items[key] = c.queue.PushFront(cacheItem{key: key, value: value})
-	if c.queue.Len() > c.capacity {
-		itemToRemove := c.queue.Back()
-		fpath, ok := itemToRemove.Value.(cacheItem).value.(string)
-		if !ok {
-			return found, ErrIncorrectFilePath
-		}
-		err = c.RemoveFile(fpath)
-		if err != nil {
-			return
-		}
-		delete(c.items, itemToRemove.Value.(cacheItem).key)
-		c.queue.Remove(itemToRemove)
+	log.Debug().Msgf("removed file %s", fpath)
+
+	return nil
+}
+
+// Returns the expiration time of the item, which is created at the given time.
+func (c *lruCache) expiresAt(created time.Time) time.Time {
+	if c.ttl <= 0 {
+		return time.Time{}
 	}
 
+	return created.Add(c.ttl)
+}
+
+// Close stops background jobs and saves the index for the last time.
+func (c *lruCache) Close() (err error) {
+	c.closed.Do(func() {
+		close(c.done)
+		err = c.SaveIndex()
+	})
+
 	return
 }
 
 func (c *lruCache) Clear() {
-	c.queue = nil
-	c.items = nil
+	for _, s := range c.shards {
+		s.mux.Lock()
+		defer s.mux.Unlock()
+		s.queue = NewList()
+		s.items = make(map[Key]*listItem)
+	}
+	atomic.StoreInt64(&c.count, 0)
+	atomic.StoreInt64(&c.size, 0)
 	os.RemoveAll(c.dir)
 }
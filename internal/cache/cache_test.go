@@ -2,14 +2,18 @@ package cache
 
 import (
 	"crypto/rand"
+	"errors"
+	"io/ioutil"
 	"math/big"
 	"os"
 	"path/filepath"
 	"strconv"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -23,8 +27,10 @@ func init() {
 	zerolog.SetGlobalLevel(zerolog.InfoLevel)
 }
 
-func checkSetItem(t *testing.T, c Cache, key Key, expected bool) {
+func checkSetItem(t *testing.T, c *lruCache, key Key, expected bool) {
 	checkFileInDir(t, c, key, expected)
+	require.NoError(t, os.MkdirAll(filepath.Dir(c.GetFilePath(key)), 0o755))
+	require.NoError(t, ioutil.WriteFile(c.GetFilePath(key), []byte("content"), 0o644))
 	wasInCache, err := c.Set(key, string(key))
 	require.NoError(t, err, err)
 	if expected {
@@ -34,7 +40,7 @@ func checkSetItem(t *testing.T, c Cache, key Key, expected bool) {
 	}
 }
 
-func checkGetItem(t *testing.T, c Cache, key Key, expected bool) {
+func checkGetItem(t *testing.T, c *lruCache, key Key, expected bool) {
 	if expected {
 		require.Equal(t, []interface{}{string(key), true}, wrap(c.Get(key)))
 	} else {
@@ -43,8 +49,8 @@ func checkGetItem(t *testing.T, c Cache, key Key, expected bool) {
 	checkFileInDir(t, c, key, expected)
 }
 
-func checkFileInDir(t *testing.T, c Cache, key Key, expected bool) {
-	_, err := os.Stat(filepath.Join(c.GetDir(), string(key)))
+func checkFileInDir(t *testing.T, c *lruCache, key Key, expected bool) {
+	_, err := os.Stat(c.GetFilePath(key))
 	if expected {
 		require.NoError(t, err)
 	} else {
@@ -54,7 +60,7 @@ func checkFileInDir(t *testing.T, c Cache, key Key, expected bool) {
 
 func TestCache(t *testing.T) {
 	t.Run("empty cache", func(t *testing.T) {
-		c, err := New(10, cacheDir)
+		c, err := newLRUCache(cacheDir, Options{Capacity: 10})
 		require.NoError(t, err, err)
 
 		checkGetItem(t, c, "aaa", false)
@@ -62,7 +68,7 @@ func TestCache(t *testing.T) {
 		c.Clear()
 	})
 	t.Run("simple", func(t *testing.T) {
-		c, err := New(5, cacheDir)
+		c, err := newLRUCache(cacheDir, Options{Capacity: 5})
 		require.NoError(t, err, err)
 
 		checkSetItem(t, c, "aaa", false)
@@ -79,7 +85,7 @@ func TestCache(t *testing.T) {
 		c.Clear()
 	})
 	t.Run("purge logic", func(t *testing.T) {
-		c, err := New(10, cacheDir)
+		c, err := newLRUCache(cacheDir, Options{Capacity: 10})
 		require.NoError(t, err, err)
 
 		checkSetItem(t, c, "aaa", false)
@@ -102,7 +108,7 @@ func TestCache(t *testing.T) {
 
 func TestCacheCapacity(t *testing.T) {
 	t.Run("check cache capacity", func(t *testing.T) {
-		c, err := New(4, cacheDir)
+		c, err := newLRUCache(cacheDir, Options{Capacity: 4})
 		require.NoError(t, err, err)
 
 		checkSetItem(t, c, "aaa", false)
@@ -118,7 +124,7 @@ func TestCacheCapacity(t *testing.T) {
 }
 
 func TestCacheMultithreading(t *testing.T) {
-	c, err := New(10, cacheDir)
+	c, err := newLRUCache(cacheDir, Options{Capacity: 10})
 	require.NoError(t, err, err)
 	wg := &sync.WaitGroup{}
 	wg.Add(2)
@@ -141,3 +147,296 @@ func TestCacheMultithreading(t *testing.T) {
 	wg.Wait()
 	c.Clear()
 }
+
+func TestCacheCommit(t *testing.T) {
+	c, err := newLRUCache(cacheDir, Options{Capacity: 10})
+	require.NoError(t, err)
+	defer c.Clear()
+
+	f, err := c.TempFile("aaa")
+	require.NoError(t, err)
+	_, err = f.WriteString("content")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	// File isn't visible, until it's committed
+	checkGetItem(t, c, "aaa", false)
+
+	require.NoError(t, c.Commit("aaa", f.Name()))
+	checkGetItem(t, c, "aaa", true)
+	data, err := ioutil.ReadFile(c.GetFilePath("aaa"))
+	require.NoError(t, err)
+	require.Equal(t, "content", string(data))
+	_, err = os.Stat(f.Name())
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestCacheSetMissingFile(t *testing.T) {
+	c, err := newLRUCache(cacheDir, Options{Capacity: 10})
+	require.NoError(t, err)
+	defer c.Clear()
+
+	_, err = c.Set("aaa", "aaa")
+	require.True(t, errors.Is(err, ErrNotFound))
+	checkGetItem(t, c, "aaa", false)
+}
+
+func TestCacheCommitUnderLock(t *testing.T) {
+	c, err := newLRUCache(cacheDir, Options{Capacity: 10})
+	require.NoError(t, err)
+	defer c.Clear()
+
+	f, err := c.TempFile("aaa")
+	require.NoError(t, err)
+	_, err = f.WriteString("content")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	// Eviction or sweeping of the previous version holds the lock, so the new file isn't moved until it's done
+	s := c.shard("aaa")
+	s.mux.Lock()
+	committed := make(chan error, 1)
+	go func() {
+		committed <- c.Commit("aaa", f.Name())
+	}()
+	time.Sleep(20 * time.Millisecond)
+	moved := c.HasFilePath("aaa")
+	s.mux.Unlock()
+	require.False(t, moved)
+
+	require.NoError(t, <-committed)
+	checkGetItem(t, c, "aaa", true)
+}
+
+func TestCacheCommitDuringSweep(t *testing.T) {
+	c, err := newLRUCache(cacheDir, Options{Capacity: 2, TTL: time.Millisecond})
+	require.NoError(t, err)
+	defer c.Clear()
+
+	done := make(chan struct{})
+	writers := &sync.WaitGroup{}
+	// The same key is committed again and again, while its previous versions are evicted by other keys
+	for g := 0; g < 6; g++ {
+		writers.Add(1)
+		go func(g int) {
+			defer writers.Done()
+			for i := 0; i < 200; i++ {
+				key := Key("aaa")
+				if g%2 == 1 {
+					key = Key(strconv.Itoa(i % 5))
+				}
+				setFile(t, c, key, 10)
+			}
+		}(g)
+	}
+	checkers := &sync.WaitGroup{}
+	checkers.Add(2)
+	// Expired versions are swept at the same time
+	go func() {
+		defer checkers.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			_, err := c.Sweep()
+			assert.NoError(t, err)
+		}
+	}()
+	// Files are only renamed, so the committed file is never empty
+	go func() {
+		defer checkers.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if info, err := os.Stat(c.GetFilePath("aaa")); err == nil {
+				assert.Equal(t, int64(10), info.Size())
+			}
+		}
+	}()
+	writers.Wait()
+	close(done)
+	checkers.Wait()
+
+	// Every item has the complete file
+	for _, s := range c.shards {
+		for key := range s.items {
+			info, err := os.Stat(c.GetFilePath(key))
+			require.NoError(t, err)
+			require.Equal(t, int64(10), info.Size(), key)
+		}
+	}
+}
+
+func TestCacheInitCleanup(t *testing.T) {
+	require.NoError(t, os.MkdirAll(cacheDir, 0o755))
+	defer os.RemoveAll(cacheDir)
+	for name, content := range map[string]string{
+		"aaa":                    "content",
+		"bbb":                    "",
+		tempFilePrefix + "ccc-1": "partial",
+	} {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(cacheDir, name), []byte(content), 0o644))
+	}
+
+	c, err := newLRUCache(cacheDir, Options{Capacity: 10})
+	require.NoError(t, err)
+
+	checkGetItem(t, c, "aaa", true)
+	checkGetItem(t, c, "bbb", false)
+	_, err = os.Stat(filepath.Join(cacheDir, tempFilePrefix+"ccc-1"))
+	require.True(t, os.IsNotExist(err))
+}
+
+// Files are written concurrently in some tests, so assert is used instead of require.
+func setFile(t *testing.T, c *lruCache, key Key, size int) {
+	f, err := c.TempFile(key)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = f.Write(make([]byte, size))
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+	assert.NoError(t, c.Commit(key, f.Name()))
+}
+
+func TestCacheMaxBytes(t *testing.T) {
+	t.Run("evict until the total size is under budget", func(t *testing.T) {
+		c, err := newLRUCache(cacheDir, Options{MaxBytes: 100})
+		require.NoError(t, err)
+		defer c.Clear()
+
+		setFile(t, c, "aaa", 30)
+		setFile(t, c, "bbb", 30)
+		setFile(t, c, "ccc", 30)
+		// "aaa" is used recently, so "bbb" should be removed first
+		checkGetItem(t, c, "aaa", true)
+		setFile(t, c, "ddd", 50)
+
+		checkGetItem(t, c, "bbb", false)
+		checkGetItem(t, c, "ccc", false)
+		checkGetItem(t, c, "aaa", true)
+		checkGetItem(t, c, "ddd", true)
+	})
+
+	t.Run("keep the last item, which is bigger than budget", func(t *testing.T) {
+		c, err := newLRUCache(cacheDir, Options{MaxBytes: 100})
+		require.NoError(t, err)
+		defer c.Clear()
+
+		setFile(t, c, "aaa", 10)
+		setFile(t, c, "bbb", 150)
+
+		checkGetItem(t, c, "aaa", false)
+		checkGetItem(t, c, "bbb", true)
+	})
+
+	t.Run("rebuild sizes on startup", func(t *testing.T) {
+		c, err := newLRUCache(cacheDir, Options{})
+		require.NoError(t, err)
+		defer c.Clear()
+		setFile(t, c, "aaa", 60)
+		setFile(t, c, "bbb", 60)
+
+		c, err = newLRUCache(cacheDir, Options{MaxBytes: 100})
+		require.NoError(t, err)
+		require.Equal(t, int64(60), c.Size())
+		require.Equal(t, 1, c.Len())
+	})
+}
+
+func TestCacheRestart(t *testing.T) {
+	c, err := newLRUCache(cacheDir, Options{Capacity: 3})
+	require.NoError(t, err)
+	defer c.Clear()
+
+	setFile(t, c, "aaa", 10)
+	setFile(t, c, "bbb", 10)
+	setFile(t, c, "ccc", 10)
+	// "bbb" becomes the least recently used one
+	checkGetItem(t, c, "aaa", true)
+	require.NoError(t, c.Close())
+	require.NoError(t, c.Close())
+
+	c, err = newLRUCache(cacheDir, Options{Capacity: 3})
+	require.NoError(t, err)
+	setFile(t, c, "ddd", 10)
+
+	checkGetItem(t, c, "bbb", false)
+	checkGetItem(t, c, "aaa", true)
+	checkGetItem(t, c, "ccc", true)
+	checkGetItem(t, c, "ddd", true)
+	require.NoError(t, c.Close())
+}
+
+func TestCacheRestartWithoutIndex(t *testing.T) {
+	require.NoError(t, os.MkdirAll(cacheDir, 0o755))
+	defer os.RemoveAll(cacheDir)
+	// Files, which are missing in the index, are ordered by modification time
+	now := time.Now()
+	for i, key := range []string{"ccc", "aaa", "bbb"} {
+		fpath := filepath.Join(cacheDir, key)
+		require.NoError(t, ioutil.WriteFile(fpath, []byte("content"), 0o644))
+		modified := now.Add(time.Duration(i-3) * time.Hour)
+		require.NoError(t, os.Chtimes(fpath, modified, modified))
+	}
+
+	c, err := newLRUCache(cacheDir, Options{Capacity: 3})
+	require.NoError(t, err)
+	setFile(t, c, "ddd", 10)
+
+	checkGetItem(t, c, "ccc", false)
+	checkGetItem(t, c, "aaa", true)
+	checkGetItem(t, c, "bbb", true)
+}
+
+func TestCacheTTL(t *testing.T) {
+	c, err := newLRUCache(cacheDir, Options{TTL: 50 * time.Millisecond})
+	require.NoError(t, err)
+	defer c.Clear()
+
+	setFile(t, c, "aaa", 10)
+	time.Sleep(60 * time.Millisecond)
+	setFile(t, c, "bbb", 10)
+
+	// Expired item is missing, but its file is removed only by sweeper
+	require.Equal(t, []interface{}{nil, false}, wrap(c.Get("aaa")))
+	checkFileInDir(t, c, "aaa", true)
+	checkGetItem(t, c, "bbb", true)
+
+	// Expiration time is restored after restart, even if TTL is changed
+	require.NoError(t, c.Close())
+	c, err = newLRUCache(cacheDir, Options{})
+	require.NoError(t, err)
+	require.Equal(t, []interface{}{nil, false}, wrap(c.Get("aaa")))
+
+	removed, err := c.Sweep()
+	require.NoError(t, err)
+	require.Equal(t, 1, removed)
+	checkGetItem(t, c, "aaa", false)
+
+	// Fresh file replaces the expired one
+	time.Sleep(60 * time.Millisecond)
+	require.Equal(t, []interface{}{nil, false}, wrap(c.Get("bbb")))
+	setFile(t, c, "bbb", 20)
+	checkGetItem(t, c, "bbb", true)
+	removed, err = c.Sweep()
+	require.NoError(t, err)
+	require.Equal(t, 0, removed)
+}
+
+func TestCacheSweeper(t *testing.T) {
+	c, err := newLRUCache(cacheDir, Options{TTL: 20 * time.Millisecond, SweepInterval: 10 * time.Millisecond})
+	require.NoError(t, err)
+	defer c.Clear()
+	defer c.Close()
+
+	setFile(t, c, "aaa", 10)
+	require.Eventually(t, func() bool {
+		return !c.HasFilePath("aaa")
+	}, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,76 @@
+package cache
+
+import (
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Returns keys of expired items. The lock is held only during the scan, files are not touched.
+func (s *shard) expiredKeys(now time.Time) []Key {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	var result []Key
+	for item := s.queue.Back(); item != nil; item = item.Prev {
+		ci := item.Value.(cacheItem)
+		if ci.isExpired(now) {
+			result = append(result, ci.key)
+		}
+	}
+
+	return result
+}
+
+// Removes the expired items of the shard. Each item is removed under the separate lock.
+func (s *shard) sweep(now time.Time) (removed int, err error) {
+	for _, key := range s.expiredKeys(now) {
+		s.mux.Lock()
+		// Item could be replaced with the fresh one after the scan
+		item, found := s.items[key]
+		if found && item.Value.(cacheItem).isExpired(now) {
+			err = s.remove(item)
+			if err == nil {
+				removed++
+			}
+		}
+		s.mux.Unlock()
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// Sweep removes expired items and their files. Items are removed one by one, so requests are not blocked,
+// while a lot of files are removed.
+func (c *lruCache) Sweep() (removed int, err error) {
+	now := time.Now()
+	for _, s := range c.shards {
+		count, errSweep := s.sweep(now)
+		removed += count
+		if errSweep != nil {
+			return removed, errSweep
+		}
+	}
+
+	return
+}
+
+// Removes expired items periodically, until the cache is closed.
+func (c *lruCache) sweepPeriodically(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			removed, err := c.Sweep()
+			if err != nil {
+				log.Error().Msgf("removing expired cache files error %s", err)
+			}
+			log.Debug().Msgf("removed %d expired cache files", removed)
+		case <-c.done:
+			return
+		}
+	}
+}
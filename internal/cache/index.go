@@ -0,0 +1,129 @@
+package cache
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Index keeps the time of the last access of each cache file, so the LRU order is restored after restart.
+// Each line contains the key, the access time and the expiration time in unix nanoseconds (zero if it doesn't expire),
+// keys of each shard go from the least recently used one.
+const indexFileName = ".index"
+
+type indexEntry struct {
+	accessed time.Time
+	expires  time.Time
+}
+
+func parseTime(value string) (time.Time, error) {
+	nsec, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || nsec == 0 {
+		return time.Time{}, err
+	}
+
+	return time.Unix(0, nsec), nil
+}
+
+func formatTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+
+	return t.UnixNano()
+}
+
+func (c *lruCache) indexPath() string {
+	return filepath.Join(c.dir, indexFileName)
+}
+
+func readIndex(path string) (map[Key]indexEntry, error) {
+	result := make(map[Key]indexEntry)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return result, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 {
+			continue
+		}
+		accessed, errAccessed := parseTime(fields[1])
+		expires, errExpires := parseTime(fields[2])
+		if errAccessed != nil || errExpires != nil {
+			continue
+		}
+		result[Key(fields[0])] = indexEntry{accessed: accessed, expires: expires}
+	}
+
+	return result, scanner.Err()
+}
+
+// SaveIndex writes the index to the temp file and renames it, so the index is never partially written.
+func (c *lruCache) SaveIndex() error {
+	var lines []string
+	for _, s := range c.shards {
+		s.mux.Lock()
+		for item := s.queue.Back(); item != nil; item = item.Prev {
+			ci := item.Value.(cacheItem)
+			lines = append(lines, fmt.Sprintf("%s %d %d\n", ci.key, formatTime(ci.accessed), formatTime(ci.expires)))
+		}
+		s.mux.Unlock()
+	}
+
+	f, err := ioutil.TempFile(c.dir, tempFilePrefix+indexFileName+"-")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, line := range lines {
+		_, err = w.WriteString(line)
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	errClose := f.Close()
+	if err == nil {
+		err = errClose
+	}
+	if err != nil {
+		os.Remove(f.Name())
+
+		return err
+	}
+	log.Debug().Msgf("saved cache index with %d items", len(lines))
+
+	return os.Rename(f.Name(), c.indexPath())
+}
+
+// Saves the index periodically, until the cache is closed.
+func (c *lruCache) saveIndexPeriodically(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.SaveIndex(); err != nil {
+				log.Error().Msgf("saving cache index error %s", err)
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
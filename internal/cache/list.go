@@ -123,8 +123,9 @@ func (l *list) MoveToFront(item *listItem) {
 		l.back = l.back.Prev
 		l.back.Next = nil
 	} else {
-		// Update link of next element
+		// Update links of neighbour elements
 		item.Next.Prev = item.Prev
+		item.Prev.Next = item.Next
 	}
 	item.Prev = nil
 	item.Next = l.front
@@ -47,6 +47,13 @@ func TestList(t *testing.T) {
 			elems = append(elems, i.Value.(int))
 		}
 		require.Equal(t, []int{50, 30, 10, 40, 60, 80, 70}, elems)
+
+		l.MoveToFront(l.Back().Prev.Prev) // [10, 70, 80, 60, 40, 30, 50]
+		forward := make([]int, 0, l.Len())
+		for i := l.Front(); i != nil; i = i.Next {
+			forward = append(forward, i.Value.(int))
+		}
+		require.Equal(t, []int{10, 70, 80, 60, 40, 30, 50}, forward)
 	})
 }
 
@@ -0,0 +1,143 @@
+package cache
+
+import (
+	"sync"
+	"time"
+)
+
+// Entry is the content of the file, kept in memory.
+type Entry struct {
+	Data        []byte
+	ContentType string
+}
+
+// MemoryCache keeps the most recently used small files in memory, so they are served without disk access.
+// It's limited by the total size of entries, files bigger than maxItemBytes are not kept.
+// Entries expire after ttl since they were added, so the file, which was written again by another
+// instance of the shared backend, isn't served from memory longer than that.
+type MemoryCache struct {
+	maxBytes     int64
+	maxItemBytes int64
+	ttl          time.Duration
+	size         int64
+	// Incremented on every removal. Versions of removed keys are kept in removed until it's full,
+	// then it's cleared and all versions before floor are considered as stale.
+	version uint64
+	floor   uint64
+	removed map[Key]uint64
+	queue   List
+	items   map[Key]*listItem
+	mux     sync.Mutex
+}
+
+// Max number of removed keys, whose versions are tracked.
+const maxRemovedKeys = 1024
+
+type memoryItem struct {
+	key     Key
+	entry   Entry
+	expires time.Time
+}
+
+// NewMemoryCache creates the cache, zero ttl means entries don't expire.
+func NewMemoryCache(maxBytes, maxItemBytes int64, ttl time.Duration) *MemoryCache {
+	return &MemoryCache{
+		maxBytes:     maxBytes,
+		maxItemBytes: maxItemBytes,
+		ttl:          ttl,
+		removed:      make(map[Key]uint64),
+		queue:        NewList(),
+		items:        make(map[Key]*listItem),
+	}
+}
+
+// Fits checks, whether the file of the given size can be kept in memory.
+func (c *MemoryCache) Fits(size int64) bool {
+	return size <= c.maxItemBytes && size <= c.maxBytes
+}
+
+func (c *MemoryCache) Get(key Key) (Entry, bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	item, found := c.items[key]
+	if !found {
+		return Entry{}, false
+	}
+	value := item.Value.(memoryItem)
+	if c.ttl > 0 && time.Now().After(value.expires) {
+		c.remove(key)
+
+		return Entry{}, false
+	}
+	c.queue.MoveToFront(item)
+
+	return value.entry, true
+}
+
+// Set adds the entry to the front of the queue, the least recently used entries are removed
+// until the total size is under budget.
+func (c *MemoryCache) Set(key Key, entry Entry) bool {
+	if !c.Fits(int64(len(entry.Data))) {
+		return false
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.set(key, entry)
+
+	return true
+}
+
+// Version is taken before reading the file from the backend and passed to Promote.
+func (c *MemoryCache) Version() uint64 {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	return c.version
+}
+
+// Promote adds the entry like Set, unless the key was removed since version was taken.
+// So the stale content isn't kept, if the file was written again while it was read.
+func (c *MemoryCache) Promote(key Key, entry Entry, version uint64) bool {
+	if !c.Fits(int64(len(entry.Data))) {
+		return false
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if version < c.floor || c.removed[key] > version {
+		return false
+	}
+	c.set(key, entry)
+
+	return true
+}
+
+func (c *MemoryCache) set(key Key, entry Entry) {
+	c.remove(key)
+	c.items[key] = c.queue.PushFront(memoryItem{key: key, entry: entry, expires: time.Now().Add(c.ttl)})
+	c.size += int64(len(entry.Data))
+	for c.size > c.maxBytes {
+		c.remove(c.queue.Back().Value.(memoryItem).key)
+	}
+}
+
+func (c *MemoryCache) Remove(key Key) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.version++
+	if len(c.removed) >= maxRemovedKeys {
+		c.removed = make(map[Key]uint64)
+		c.floor = c.version
+	}
+	c.removed[key] = c.version
+	c.remove(key)
+}
+
+func (c *MemoryCache) remove(key Key) {
+	item, found := c.items[key]
+	if !found {
+		return
+	}
+	c.size -= int64(len(item.Value.(memoryItem).entry.Data))
+	delete(c.items, key)
+	c.queue.Remove(item)
+}
@@ -0,0 +1,96 @@
+package cache
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func entry(size int) Entry {
+	return Entry{Data: make([]byte, size), ContentType: "image/png"}
+}
+
+func TestMemoryCache(t *testing.T) {
+	t.Run("evict until the total size is under budget", func(t *testing.T) {
+		c := NewMemoryCache(100, 50, 0)
+
+		require.True(t, c.Set("aaa", entry(40)))
+		require.True(t, c.Set("bbb", entry(40)))
+		_, found := c.Get("aaa")
+		require.True(t, found)
+		require.True(t, c.Set("ccc", entry(40)))
+
+		_, found = c.Get("bbb")
+		require.False(t, found)
+		e, found := c.Get("aaa")
+		require.True(t, found)
+		require.Equal(t, entry(40), e)
+		_, found = c.Get("ccc")
+		require.True(t, found)
+	})
+
+	t.Run("skip big entries", func(t *testing.T) {
+		c := NewMemoryCache(100, 50, 0)
+
+		require.False(t, c.Fits(60))
+		require.False(t, c.Set("aaa", entry(60)))
+		_, found := c.Get("aaa")
+		require.False(t, found)
+	})
+
+	t.Run("replace and remove entries", func(t *testing.T) {
+		c := NewMemoryCache(100, 50, 0)
+
+		require.True(t, c.Set("aaa", entry(40)))
+		require.True(t, c.Set("aaa", entry(50)))
+		require.Equal(t, int64(50), c.size)
+		c.Remove("aaa")
+		require.Equal(t, int64(0), c.size)
+		_, found := c.Get("aaa")
+		require.False(t, found)
+	})
+
+	t.Run("skip promotion, if entry was removed after reading", func(t *testing.T) {
+		c := NewMemoryCache(100, 50, 0)
+
+		version := c.Version()
+		c.Remove("aaa")
+		require.False(t, c.Promote("aaa", entry(40), version))
+		_, found := c.Get("aaa")
+		require.False(t, found)
+
+		require.True(t, c.Promote("aaa", entry(40), c.Version()))
+		_, found = c.Get("aaa")
+		require.True(t, found)
+	})
+	t.Run("promote, if other entries were removed after reading", func(t *testing.T) {
+		c := NewMemoryCache(100, 50, 0)
+
+		version := c.Version()
+		c.Remove("bbb")
+		require.True(t, c.Promote("aaa", entry(40), version))
+
+		// Versions of the forgotten keys are stale
+		version = c.Version()
+		c.Remove("aaa")
+		for i := 0; i < maxRemovedKeys; i++ {
+			c.Remove(Key(fmt.Sprintf("key%d", i)))
+		}
+		require.False(t, c.Promote("aaa", entry(40), version))
+		require.True(t, c.Promote("aaa", entry(40), c.Version()))
+	})
+
+	t.Run("expire entries", func(t *testing.T) {
+		c := NewMemoryCache(100, 50, 50*time.Millisecond)
+
+		require.True(t, c.Set("aaa", entry(40)))
+		_, found := c.Get("aaa")
+		require.True(t, found)
+		time.Sleep(60 * time.Millisecond)
+		_, found = c.Get("aaa")
+		require.False(t, found)
+		require.Equal(t, int64(0), c.size)
+	})
+}
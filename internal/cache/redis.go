@@ -0,0 +1,153 @@
+package cache
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/rs/zerolog/log"
+)
+
+var ErrEmptyPrefix = errors.New("prefix is required to clear the shared store")
+
+type RedisOptions struct {
+	Address  string
+	Password string
+	DB       int
+	// Prefix of the keys, so the same database can be shared with other apps
+	Prefix string
+	// Max age of entries, zero means they don't expire
+	TTL time.Duration
+	// Timeout of connecting, reading and writing, zero means no timeout
+	Timeout time.Duration
+}
+
+// redisCache keeps the entries in the Redis-protocol store, so they are shared between several instances.
+// Each entry is the hash with the content and its type. Eviction of the least recently used entries
+// is left for the store, e.g. maxmemory-policy allkeys-lru.
+type redisCache struct {
+	pool   *redis.Pool
+	prefix string
+	ttl    time.Duration
+}
+
+const (
+	redisDataField = "data"
+	redisTypeField = "type"
+)
+
+func NewRedis(options RedisOptions) (Cache, error) {
+	pool := &redis.Pool{
+		MaxIdle:     10,
+		IdleTimeout: 5 * time.Minute,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial(
+				"tcp", options.Address,
+				redis.DialPassword(options.Password),
+				redis.DialDatabase(options.DB),
+				redis.DialConnectTimeout(options.Timeout),
+				redis.DialReadTimeout(options.Timeout),
+				redis.DialWriteTimeout(options.Timeout),
+			)
+		},
+	}
+	c := &redisCache{pool: pool, prefix: options.Prefix, ttl: options.TTL}
+	// PING fails on start, if the address or password is wrong
+	conn := pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("PING")
+
+	return c, err
+}
+
+func (c *redisCache) key(key Key) string {
+	return c.prefix + string(key)
+}
+
+// Has uses TOUCH, so the access time of the entry is updated for LRU eviction of the store.
+func (c *redisCache) Has(key Key) bool {
+	conn := c.pool.Get()
+	defer conn.Close()
+	found, err := redis.Bool(conn.Do("TOUCH", c.key(key)))
+	if err != nil {
+		log.Error().Msgf("checking redis key error %s", err)
+	}
+
+	return found
+}
+
+func (c *redisCache) Open(key Key) (io.ReadCloser, Meta, error) {
+	conn := c.pool.Get()
+	defer conn.Close()
+	values, err := redis.ByteSlices(conn.Do("HMGET", c.key(key), redisDataField, redisTypeField))
+	if err != nil {
+		return nil, Meta{}, err
+	}
+	if values[0] == nil {
+		return nil, Meta{}, ErrNotFound
+	}
+	meta := Meta{ContentType: string(values[1]), Size: int64(len(values[0]))}
+
+	return ioutil.NopCloser(bytes.NewReader(values[0])), meta, nil
+}
+
+// Create buffers the entry, which is written at once by MULTI/EXEC, so it's never read partially.
+func (c *redisCache) Create(key Key, contentType string) (Writer, error) {
+	return newBufferWriter(func(data []byte) error {
+		conn := c.pool.Get()
+		defer conn.Close()
+		_ = conn.Send("MULTI")
+		_ = conn.Send("DEL", c.key(key))
+		_ = conn.Send("HSET", c.key(key), redisDataField, data, redisTypeField, contentType)
+		if c.ttl > 0 {
+			_ = conn.Send("PEXPIRE", c.key(key), c.ttl.Milliseconds())
+		}
+		_, err := conn.Do("EXEC")
+
+		return err
+	}), nil
+}
+
+// Escapes glob characters of SCAN MATCH pattern.
+var redisPatternEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+// Clear removes all entries with the prefix, the database could be shared with other apps.
+func (c *redisCache) Clear() {
+	if c.prefix == "" {
+		log.Error().Msgf("clearing redis cache error %s", ErrEmptyPrefix)
+
+		return
+	}
+	conn := c.pool.Get()
+	defer conn.Close()
+	cursor := 0
+	for {
+		values, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", redisPatternEscaper.Replace(c.prefix)+"*"))
+		if err != nil {
+			log.Error().Msgf("scanning redis keys error %s", err)
+
+			return
+		}
+		var keys []interface{}
+		_, err = redis.Scan(values, &cursor, &keys)
+		if err == nil && len(keys) > 0 {
+			_, err = conn.Do("DEL", keys...)
+		}
+		if err != nil {
+			log.Error().Msgf("removing redis keys error %s", err)
+
+			return
+		}
+		if cursor == 0 {
+			return
+		}
+	}
+}
+
+func (c *redisCache) Close() error {
+	return c.pool.Close()
+}
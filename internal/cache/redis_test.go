@@ -0,0 +1,79 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedisBackend(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+	// Keys of other apps are not touched
+	require.NoError(t, s.Set("other", "value"))
+
+	c, err := NewRedis(RedisOptions{Address: s.Addr(), Prefix: "previewer:"})
+	require.NoError(t, err)
+	defer c.Close()
+
+	testBackend(t, c)
+	require.True(t, s.Exists("other"))
+}
+
+func TestRedisTTL(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+
+	c, err := NewRedis(RedisOptions{Address: s.Addr(), Prefix: "previewer:", TTL: time.Minute})
+	require.NoError(t, err)
+	defer c.Close()
+
+	writeEntry(t, c, "aaa", "content")
+	require.Equal(t, time.Minute, s.TTL("previewer:aaa"))
+	s.FastForward(time.Minute)
+	require.False(t, c.Has("aaa"))
+}
+
+func TestRedisConnectionError(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	addr := s.Addr()
+	s.Close()
+
+	_, err = NewRedis(RedisOptions{Address: addr})
+	require.Error(t, err)
+}
+
+func TestRedisClear(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+	require.NoError(t, s.Set("other", "value"))
+	require.NoError(t, s.Set("pre-other", "value"))
+
+	t.Run("should keep all keys without prefix", func(t *testing.T) {
+		c, err := NewRedis(RedisOptions{Address: s.Addr()})
+		require.NoError(t, err)
+		defer c.Close()
+
+		writeEntry(t, c, "aaa", "content")
+		c.Clear()
+		require.True(t, c.Has("aaa"))
+		require.True(t, s.Exists("other"))
+	})
+
+	t.Run("should escape glob characters of prefix", func(t *testing.T) {
+		c, err := NewRedis(RedisOptions{Address: s.Addr(), Prefix: "pre*"})
+		require.NoError(t, err)
+		defer c.Close()
+
+		writeEntry(t, c, "aaa", "content")
+		c.Clear()
+		require.False(t, c.Has("aaa"))
+		require.True(t, s.Exists("pre-other"))
+	})
+}
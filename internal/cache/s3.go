@@ -0,0 +1,200 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/rs/zerolog/log"
+)
+
+type S3Options struct {
+	// Endpoint of S3-compatible storage, e.g. http://minio:9000. AWS endpoint is used, if it's empty
+	Endpoint  string
+	Region    string
+	Bucket    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	// Max age of entries, zero means they don't expire. Old objects should be removed by bucket lifecycle rules
+	TTL time.Duration
+	// Timeout of each request, including reading of the object, zero means no timeout
+	Timeout time.Duration
+}
+
+// s3Cache keeps the entries as objects in S3-compatible bucket. Content type is kept as object metadata.
+type s3Cache struct {
+	client  *s3.S3
+	bucket  string
+	prefix  string
+	ttl     time.Duration
+	timeout time.Duration
+}
+
+func NewS3(options S3Options) (Cache, error) {
+	cfg := aws.NewConfig().
+		WithRegion(options.Region).
+		WithCredentials(credentials.NewStaticCredentials(options.AccessKey, options.SecretKey, "")).
+		WithHTTPClient(&http.Client{Timeout: options.Timeout})
+	if options.Endpoint != "" {
+		// Most of S3-compatible storages don't support virtual-hosted buckets
+		cfg = cfg.WithEndpoint(options.Endpoint).WithS3ForcePathStyle(true)
+	}
+	sess, err := session.NewSession(cfg)
+	if err != nil {
+		return nil, err
+	}
+	c := &s3Cache{
+		client:  s3.New(sess),
+		bucket:  options.Bucket,
+		prefix:  options.Prefix,
+		ttl:     options.TTL,
+		timeout: options.Timeout,
+	}
+	// HEAD request fails on start, if the bucket or credentials are wrong
+	ctx, cancel := c.context()
+	defer cancel()
+	_, err = c.client.HeadBucketWithContext(ctx, &s3.HeadBucketInput{Bucket: aws.String(c.bucket)})
+
+	return c, err
+}
+
+// Returns the context of the single request, which is limited by the timeout.
+func (c *s3Cache) context() (context.Context, context.CancelFunc) {
+	if c.timeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+
+	return context.WithTimeout(context.Background(), c.timeout)
+}
+
+func (c *s3Cache) key(key Key) *string {
+	return aws.String(c.prefix + string(key))
+}
+
+func isS3NotFound(err error) bool {
+	var awsErr awserr.RequestFailure
+
+	return errors.As(err, &awsErr) && awsErr.StatusCode() == http.StatusNotFound
+}
+
+// Objects, which are older than TTL, are considered as missing.
+func (c *s3Cache) isExpired(lastModified *time.Time) bool {
+	return c.ttl > 0 && lastModified != nil && time.Since(*lastModified) >= c.ttl
+}
+
+func (c *s3Cache) Has(key Key) bool {
+	ctx, cancel := c.context()
+	defer cancel()
+	output, err := c.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{Bucket: aws.String(c.bucket), Key: c.key(key)})
+	if err != nil {
+		if !isS3NotFound(err) {
+			log.Error().Msgf("checking s3 object error %s", err)
+		}
+
+		return false
+	}
+
+	return !c.isExpired(output.LastModified)
+}
+
+// Body is read within the timeout of the request, which is cancelled, when the body is closed.
+type s3Body struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b s3Body) Close() error {
+	defer b.cancel()
+
+	return b.ReadCloser.Close()
+}
+
+func (c *s3Cache) Open(key Key) (io.ReadCloser, Meta, error) {
+	ctx, cancel := c.context()
+	output, err := c.client.GetObjectWithContext(ctx, &s3.GetObjectInput{Bucket: aws.String(c.bucket), Key: c.key(key)})
+	if err != nil {
+		cancel()
+		if isS3NotFound(err) {
+			return nil, Meta{}, ErrNotFound
+		}
+
+		return nil, Meta{}, err
+	}
+	if c.isExpired(output.LastModified) {
+		output.Body.Close()
+		cancel()
+
+		return nil, Meta{}, ErrNotFound
+	}
+	// Size is taken from the response, so it always matches the content
+	meta := Meta{ContentType: aws.StringValue(output.ContentType), Size: aws.Int64Value(output.ContentLength)}
+
+	return s3Body{ReadCloser: output.Body, cancel: cancel}, meta, nil
+}
+
+// Create buffers the object, which is uploaded at once, so it's never read partially.
+func (c *s3Cache) Create(key Key, contentType string) (Writer, error) {
+	return newBufferWriter(func(data []byte) error {
+		ctx, cancel := c.context()
+		defer cancel()
+		_, err := c.client.PutObjectWithContext(ctx, &s3.PutObjectInput{
+			Bucket:      aws.String(c.bucket),
+			Key:         c.key(key),
+			Body:        bytes.NewReader(data),
+			ContentType: aws.String(contentType),
+		})
+
+		return err
+	}), nil
+}
+
+// Clear removes all objects with the prefix, the bucket could be shared with other apps.
+func (c *s3Cache) Clear() {
+	if c.prefix == "" {
+		log.Error().Msgf("clearing s3 cache error %s", ErrEmptyPrefix)
+
+		return
+	}
+	// Listing of all pages can take longer than the single request, each page is limited by the HTTP client timeout
+	err := c.client.ListObjectsV2PagesWithContext(context.Background(), &s3.ListObjectsV2Input{
+		Bucket: aws.String(c.bucket),
+		Prefix: aws.String(c.prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		if len(page.Contents) == 0 {
+			return true
+		}
+		objects := make([]*s3.ObjectIdentifier, 0, len(page.Contents))
+		for _, object := range page.Contents {
+			objects = append(objects, &s3.ObjectIdentifier{Key: object.Key})
+		}
+		ctxDelete, cancel := c.context()
+		defer cancel()
+		_, err := c.client.DeleteObjectsWithContext(ctxDelete, &s3.DeleteObjectsInput{
+			Bucket: aws.String(c.bucket),
+			Delete: &s3.Delete{Objects: objects, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			log.Error().Msgf("removing s3 objects error %s", err)
+
+			return false
+		}
+
+		return true
+	})
+	if err != nil {
+		log.Error().Msgf("listing s3 objects error %s", err)
+	}
+}
+
+func (c *s3Cache) Close() error {
+	return nil
+}
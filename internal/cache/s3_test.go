@@ -0,0 +1,246 @@
+package cache
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type fakeObject struct {
+	data     []byte
+	header   http.Header
+	modified time.Time
+}
+
+// Fake S3-compatible storage with path-style buckets, it supports only requests, which are used by cache.
+type fakeS3 struct {
+	buckets map[string]map[string]*fakeObject
+	mux     sync.Mutex
+}
+
+func newFakeS3(buckets ...string) *fakeS3 {
+	s := &fakeS3{buckets: make(map[string]map[string]*fakeObject)}
+	for _, bucket := range buckets {
+		s.buckets[bucket] = make(map[string]*fakeObject)
+	}
+
+	return s
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	objects, ok := s.buckets[parts[0]]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+
+		return
+	}
+	if len(parts) == 1 || parts[1] == "" {
+		s.serveBucket(w, r, objects)
+
+		return
+	}
+	key := parts[1]
+	switch r.Method {
+	case http.MethodPut:
+		data, _ := ioutil.ReadAll(r.Body)
+		header := http.Header{"Content-Type": r.Header["Content-Type"]}
+		for name, values := range r.Header {
+			if strings.HasPrefix(strings.ToLower(name), "x-amz-meta-") {
+				header[name] = values
+			}
+		}
+		objects[key] = &fakeObject{data: data, header: header, modified: time.Now()}
+	case http.MethodGet, http.MethodHead:
+		object, ok := objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			if r.Method == http.MethodGet {
+				_, _ = w.Write([]byte("<Error><Code>NoSuchKey</Code></Error>"))
+			}
+
+			return
+		}
+		for name, values := range object.header {
+			w.Header()[name] = values
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(object.data)))
+		w.Header().Set("Last-Modified", object.modified.UTC().Format(http.TimeFormat))
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(object.data)
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *fakeS3) serveBucket(w http.ResponseWriter, r *http.Request, objects map[string]*fakeObject) {
+	type object struct {
+		Key string `xml:"Key"`
+	}
+	switch {
+	case r.Method == http.MethodHead:
+	case r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "2":
+		result := struct {
+			XMLName     xml.Name `xml:"ListBucketResult"`
+			Contents    []object `xml:"Contents"`
+			IsTruncated bool     `xml:"IsTruncated"`
+		}{}
+		for key := range objects {
+			if strings.HasPrefix(key, r.URL.Query().Get("prefix")) {
+				result.Contents = append(result.Contents, object{Key: key})
+			}
+		}
+		_ = xml.NewEncoder(w).Encode(result)
+	case r.Method == http.MethodPost && r.URL.Query()["delete"] != nil:
+		request := struct {
+			Objects []object `xml:"Object"`
+		}{}
+		_ = xml.NewDecoder(r.Body).Decode(&request)
+		for _, o := range request.Objects {
+			delete(objects, o.Key)
+		}
+		_, _ = w.Write([]byte("<DeleteResult></DeleteResult>"))
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// Makes all objects older, so their expiration can be checked.
+func (s *fakeS3) age(d time.Duration) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for _, objects := range s.buckets {
+		for _, object := range objects {
+			object.modified = object.modified.Add(-d)
+		}
+	}
+}
+
+func (s *fakeS3) has(bucket, key string) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	_, ok := s.buckets[bucket][key]
+
+	return ok
+}
+
+func newS3Options(url string) S3Options {
+	return S3Options{
+		Endpoint:  url,
+		Region:    "us-east-1",
+		Bucket:    "previews",
+		Prefix:    "previewer/",
+		AccessKey: "key",
+		SecretKey: "secret",
+	}
+}
+
+func TestS3Backend(t *testing.T) {
+	fake := newFakeS3("previews")
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	// Objects of other apps are not touched
+	fake.buckets["previews"]["other"] = &fakeObject{modified: time.Now()}
+
+	c, err := NewS3(newS3Options(srv.URL))
+	require.NoError(t, err)
+	defer c.Close()
+
+	testBackend(t, c)
+	require.True(t, fake.has("previews", "other"))
+}
+
+func TestS3Metadata(t *testing.T) {
+	fake := newFakeS3("previews")
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	c, err := NewS3(newS3Options(srv.URL))
+	require.NoError(t, err)
+
+	writeEntry(t, c, "aaa", "content")
+	object := fake.buckets["previews"]["previewer/aaa"]
+	require.Equal(t, "image/png", object.header.Get("Content-Type"))
+
+	// Size is taken from the response, not from the metadata, which can be changed by anyone with bucket access
+	object.header.Set("X-Amz-Meta-Size", "1000")
+	content, meta, err := c.Open("aaa")
+	require.NoError(t, err)
+	defer content.Close()
+	require.Equal(t, int64(7), meta.Size)
+}
+
+func TestS3Clear(t *testing.T) {
+	fake := newFakeS3("previews")
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	options := newS3Options(srv.URL)
+	options.Prefix = ""
+	c, err := NewS3(options)
+	require.NoError(t, err)
+
+	// Bucket can be shared with other apps, so nothing is removed without the prefix
+	writeEntry(t, c, "aaa", "content")
+	c.Clear()
+	require.True(t, c.Has("aaa"))
+}
+
+func TestS3Timeout(t *testing.T) {
+	fake := newFakeS3("previews")
+	delay := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead && strings.Contains(r.URL.Path, "slow") {
+			<-delay
+		}
+		fake.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	defer close(delay)
+
+	options := newS3Options(srv.URL)
+	options.Timeout = 50 * time.Millisecond
+	c, err := NewS3(options)
+	require.NoError(t, err)
+
+	started := time.Now()
+	require.False(t, c.Has("slow"))
+	require.Less(t, int64(time.Since(started)), int64(time.Second))
+}
+
+func TestS3TTL(t *testing.T) {
+	fake := newFakeS3("previews")
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	options := newS3Options(srv.URL)
+	options.TTL = time.Hour
+	c, err := NewS3(options)
+	require.NoError(t, err)
+
+	writeEntry(t, c, "aaa", "content")
+	require.True(t, c.Has("aaa"))
+	fake.age(time.Hour)
+	require.False(t, c.Has("aaa"))
+	_, _, err = c.Open("aaa")
+	require.Equal(t, ErrNotFound, err)
+}
+
+func TestS3MissingBucket(t *testing.T) {
+	srv := httptest.NewServer(newFakeS3())
+	defer srv.Close()
+
+	_, err := NewS3(newS3Options(srv.URL))
+	require.Error(t, err)
+}
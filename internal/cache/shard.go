@@ -0,0 +1,120 @@
+package cache
+
+import (
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// shard is the part of LRU with its own lock, so requests for different keys don't wait for each other.
+// Limits are global, they are shared by all shards of the cache, but the items are evicted from the shard,
+// where the new one is added.
+type shard struct {
+	cache *lruCache
+	queue List
+	items map[Key]*listItem
+	mux   sync.Mutex
+}
+
+func newShard(cache *lruCache) *shard {
+	return &shard{cache: cache, queue: NewList(), items: make(map[Key]*listItem)}
+}
+
+func (s *shard) get(key Key, now time.Time) (interface{}, bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	item, found := s.items[key]
+	if !found {
+		return nil, false
+	}
+	ci := item.Value.(cacheItem)
+	// Expired item is removed by sweeper, until that it's considered as missing
+	if ci.isExpired(now) {
+		return nil, false
+	}
+	s.queue.MoveToFront(item)
+	ci.accessed = now
+	item.Value = ci
+
+	return ci.value, true
+}
+
+func (s *shard) set(ci cacheItem) (found bool, err error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	return s.add(ci)
+}
+
+// Moves the temp file into the place of the cache file and adds the item. Both are done under the lock,
+// so the file can't be removed by the eviction or expiration of the previous version in between.
+func (s *shard) commit(tempPath string, ci cacheItem) (found bool, err error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	err = s.cache.moveFile(tempPath, s.cache.GetFilePath(ci.key))
+	if err != nil {
+		return false, err
+	}
+
+	return s.add(ci)
+}
+
+// Adds the item for the existing file, the lock should be held by caller. Items are evicted
+// by the cache after that, as the limits are global.
+func (s *shard) add(ci cacheItem) (found bool, err error) {
+	key := ci.key
+	if _, ok := ci.value.(string); !ok {
+		return false, ErrIncorrectFilePath
+	}
+	// File could be replaced, so the size is taken each time
+	info, err := os.Stat(s.cache.GetFilePath(key))
+	if os.IsNotExist(err) {
+		return false, ErrNotFound
+	}
+	if err != nil {
+		return false, err
+	}
+	item, found := s.items[key]
+	if found {
+		s.forget(item)
+	}
+	ci.size = info.Size()
+	s.items[key] = s.queue.PushFront(ci)
+	atomic.AddInt64(&s.cache.count, 1)
+	atomic.AddInt64(&s.cache.size, ci.size)
+
+	return found, nil
+}
+
+// Removes the least recently used item of the shard, unless it's the skipped key.
+func (s *shard) evictOldest(skip Key) (bool, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	item := s.queue.Back()
+	if item == nil || item.Value.(cacheItem).key == skip {
+		return false, nil
+	}
+
+	return true, s.remove(item)
+}
+
+// Removes the item and its file, the lock should be held by caller.
+func (s *shard) remove(item *listItem) error {
+	err := s.cache.RemoveFile(item.Value.(cacheItem).key)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	s.forget(item)
+
+	return nil
+}
+
+// Removes the item without its file, the lock should be held by caller.
+func (s *shard) forget(item *listItem) {
+	removed := item.Value.(cacheItem)
+	delete(s.items, removed.key)
+	s.queue.Remove(item)
+	atomic.AddInt64(&s.cache.count, -1)
+	atomic.AddInt64(&s.cache.size, -removed.size)
+}
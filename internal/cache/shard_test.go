@@ -0,0 +1,176 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func hexKey(i int) Key {
+	return Key(fmt.Sprintf("%x", sha256.Sum256([]byte(strconv.Itoa(i)))))
+}
+
+func TestShardedLayout(t *testing.T) {
+	c, err := newLRUCache(cacheDir, Options{Shards: 4})
+	require.NoError(t, err)
+	defer c.Clear()
+
+	key := hexKey(1)
+	require.Equal(t, filepath.Join(cacheDir, string(key[0:2]), string(key[2:4]), string(key)), c.GetFilePath(key))
+	writeEntry(t, c, key, "content")
+	checkFileInDir(t, c, key, true)
+	result, _ := readEntry(t, c, key)
+	require.Equal(t, "content", result)
+
+	// The same key always gets the same shard
+	require.Same(t, c.shard(key), c.shard(key))
+}
+
+func TestShardedCapacity(t *testing.T) {
+	c, err := newLRUCache(cacheDir, Options{Shards: 4, Capacity: 40})
+	require.NoError(t, err)
+	defer c.Clear()
+
+	added := make(map[*shard][]Key)
+	for i := 0; i < 100; i++ {
+		key := hexKey(i)
+		writeEntry(t, c, key, "content")
+		added[c.shard(key)] = append(added[c.shard(key)], key)
+	}
+	// Limit is global, items are evicted from the shard of the added one in LRU order
+	require.Len(t, c.shards, 4)
+	require.Equal(t, 40, c.Len())
+	require.True(t, c.Has(hexKey(99)))
+	for s, keys := range added {
+		kept := len(s.items)
+		for i, key := range keys {
+			require.Equal(t, i >= len(keys)-kept, c.Has(key), "item %s", key)
+		}
+	}
+
+	t.Run("should keep the limit, if it's less than the count of shards", func(t *testing.T) {
+		c, err := newLRUCache(cacheDir, Options{Shards: 16, Capacity: 3, MaxBytes: 100})
+		require.NoError(t, err)
+		defer c.Clear()
+		require.Len(t, c.shards, 1)
+
+		for i := 0; i < 10; i++ {
+			writeEntry(t, c, hexKey(i), "content")
+		}
+		require.Equal(t, 3, c.Len())
+		require.Equal(t, int64(3*len("content")), c.Size())
+	})
+}
+
+func TestShardedEvictionLocks(t *testing.T) {
+	c, err := newLRUCache(cacheDir, Options{Shards: 2, Capacity: 2 * minShardItems})
+	require.NoError(t, err)
+	defer c.Clear()
+
+	// Keys of both shards are added, then the full cache gets new keys of the first shard
+	var first, second []Key
+	for i := 0; len(first) < 2*minShardItems+1 || len(second) < 1; i++ {
+		if key := hexKey(i); c.shard(key) == c.shards[0] {
+			first = append(first, key)
+		} else {
+			second = append(second, key)
+		}
+	}
+	for _, key := range first[:2*minShardItems-1] {
+		writeEntry(t, c, key, "content")
+	}
+	writeEntry(t, c, second[0], "content")
+
+	// Other shard isn't locked by the eviction
+	c.shards[1].mux.Lock()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, key := range first[2*minShardItems-1:] {
+			w, err := c.Create(key, "image/png")
+			if assert.NoError(t, err) {
+				_, _ = w.Write([]byte("content"))
+				assert.NoError(t, w.Commit())
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("eviction waits for the lock of another shard")
+	}
+	c.shards[1].mux.Unlock()
+	<-done
+
+	require.Equal(t, 2*minShardItems, c.Len())
+	require.False(t, c.Has(first[0]))
+	require.False(t, c.Has(first[1]))
+	require.True(t, c.Has(first[2]))
+	require.True(t, c.Has(second[0]))
+}
+
+func TestMigration(t *testing.T) {
+	require.NoError(t, os.MkdirAll(cacheDir, 0o755))
+	defer os.RemoveAll(cacheDir)
+	// Files of the flat layout
+	for i := 0; i < 10; i++ {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(cacheDir, string(hexKey(i))), []byte("content"), 0o644))
+	}
+
+	c, err := newLRUCache(cacheDir, Options{Shards: 4})
+	require.NoError(t, err)
+	require.Equal(t, 10, c.Len())
+	for i := 0; i < 10; i++ {
+		key := hexKey(i)
+		require.True(t, c.Has(key))
+		checkFileInDir(t, c, key, true)
+		_, err = os.Stat(filepath.Join(cacheDir, string(key)))
+		require.True(t, os.IsNotExist(err))
+	}
+
+	// Nested files are found after restart
+	c, err = newLRUCache(cacheDir, Options{Shards: 4})
+	require.NoError(t, err)
+	require.Equal(t, 10, c.Len())
+}
+
+func TestShardedMultithreading(t *testing.T) {
+	c, err := newLRUCache(cacheDir, Options{Shards: 8, Capacity: 40})
+	require.NoError(t, err)
+	defer c.Clear()
+
+	wg := &sync.WaitGroup{}
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				key := hexKey(g*50 + i)
+				w, err := c.Create(key, "image/png")
+				if err != nil {
+					t.Error(err)
+
+					return
+				}
+				_, _ = w.Write([]byte("content"))
+				if err = w.Commit(); err != nil {
+					t.Error(err)
+
+					return
+				}
+				c.Has(hexKey(i))
+			}
+		}(g)
+	}
+	wg.Wait()
+	require.Equal(t, 40, c.Len())
+}
@@ -2,12 +2,17 @@ package config
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"time"
 
 	"github.com/heetch/confita"
 	"github.com/heetch/confita/backend/env"
 	"github.com/heetch/confita/backend/file"
 )
 
+var ErrInvalidRange = errors.New("invalid range")
+
 type Config struct {
 	Host        string `yaml:"host" config:"required"`
 	Port        int    `yaml:"port" config:"required"`
@@ -15,16 +20,114 @@ type Config struct {
 	CacheSize   int    `yaml:"cacheSize" config:"required"`
 	LogLevel    string `yaml:"logLevel"`
 	MaxFileSize int64  `yaml:"maxFileSize" config:"required"`
+	// Total size of cached files in bytes, zero means no limit. CacheSize limits the count of files the same way
+	CacheMaxBytes int64 `yaml:"cacheMaxBytes" config:"cache_max_bytes"`
+	// Storage of cached files: "file", "redis" or "s3"
+	CacheBackend string `yaml:"cacheBackend" config:"cache_backend"`
+	// Connection to Redis-protocol store, if it's used as cache backend. Keys are prefixed with RedisPrefix
+	RedisAddress  string `yaml:"redisAddress" config:"redis_address"`
+	RedisPassword string `yaml:"redisPassword" config:"redis_password"`
+	RedisDB       int    `yaml:"redisDB" config:"redis_db"`
+	RedisPrefix   string `yaml:"redisPrefix" config:"redis_prefix"`
+	// Timeout of connecting to Redis, reading and writing, zero means no timeout
+	RedisTimeout time.Duration `yaml:"redisTimeout" config:"redis_timeout"`
+	// S3-compatible bucket, if it's used as cache backend. AWS endpoint is used, if S3Endpoint is empty
+	S3Endpoint  string `yaml:"s3Endpoint" config:"s3_endpoint"`
+	S3Region    string `yaml:"s3Region" config:"s3_region"`
+	S3Bucket    string `yaml:"s3Bucket" config:"s3_bucket"`
+	S3Prefix    string `yaml:"s3Prefix" config:"s3_prefix"`
+	S3AccessKey string `yaml:"s3AccessKey" config:"s3_access_key"`
+	S3SecretKey string `yaml:"s3SecretKey" config:"s3_secret_key"`
+	// Timeout of each request to S3, including reading of the object, zero means no timeout
+	S3Timeout time.Duration `yaml:"s3Timeout" config:"s3_timeout"`
+	// How often the LRU order of cached files is saved to disk, besides the shutdown
+	CacheIndexInterval time.Duration `yaml:"cacheIndexInterval" config:"cache_index_interval"`
+	// Count of LRU shards with separate locks, CacheSize and CacheMaxBytes are shared by them.
+	// It's reduced for the small CacheSize, so each shard keeps enough files
+	CacheShards int `yaml:"cacheShards" config:"cache_shards"`
+	// Max age of cached files, zero means they are kept until they are evicted. Expired files are removed
+	// every CacheSweepInterval
+	CacheTTL           time.Duration `yaml:"cacheTTL" config:"cache_ttl"`
+	CacheSweepInterval time.Duration `yaml:"cacheSweepInterval" config:"cache_sweep_interval"`
+	// Total size of files, which are kept in memory, zero disables it. Only files up to
+	// MemoryCacheMaxItemBytes are kept
+	MemoryCacheMaxBytes     int64 `yaml:"memoryCacheMaxBytes" config:"memory_cache_max_bytes"`
+	MemoryCacheMaxItemBytes int64 `yaml:"memoryCacheMaxItemBytes" config:"memory_cache_max_item_bytes"`
+	// Quality of lossy formats (jpeg, webp), 1-100
+	Quality    int `yaml:"quality" config:"quality"`
+	MinQuality int `yaml:"minQuality" config:"min_quality"`
+	MaxQuality int `yaml:"maxQuality" config:"max_quality"`
+	// Compression level of png, 0-9
+	Compression    int  `yaml:"compression" config:"compression"`
+	MinCompression int  `yaml:"minCompression" config:"min_compression"`
+	MaxCompression int  `yaml:"maxCompression" config:"max_compression"`
+	WebpLossless   bool `yaml:"webpLossless" config:"webp_lossless"`
+	// Processing of EXIF/ICC metadata: "strip" or "keep" (only safe fields)
+	Metadata string `yaml:"metadata" config:"metadata"`
+	// Keys for URL signatures. Signatures are not checked, if keys are not set
+	SignatureKeys []string `yaml:"signatureKeys" config:"signature_keys"`
+	// Accept URLs with "unsafe" instead of signature
+	AllowUnsafe bool `yaml:"allowUnsafe" config:"allow_unsafe"`
+	// Named presets, e.g. thumb: "fill 150x150 q=70"
+	Presets map[string]string `yaml:"presets"`
+	// Disable raw /<method>/<width>/<height>/... URLs, only presets are allowed
+	PresetsOnly bool `yaml:"presetsOnly" config:"presets_only"`
+	// Scheme of external urls, which are set without it
+	DefaultScheme string `yaml:"defaultScheme" config:"default_scheme"`
+	// Hosts, which are always fetched via https or http, e.g. *.example.com
+	HTTPSHosts []string `yaml:"httpsHosts" config:"https_hosts"`
+	HTTPHosts  []string `yaml:"httpHosts" config:"http_hosts"`
+	// External hosts, which can (or can't) be fetched, e.g. *.example.com. All hosts are allowed, if it's empty
+	AllowedHosts []string `yaml:"allowedHosts" config:"allowed_hosts"`
+	DeniedHosts  []string `yaml:"deniedHosts" config:"denied_hosts"`
+	// Allow fetching from loopback, link-local and private addresses
+	AllowPrivateNetworks bool `yaml:"allowPrivateNetworks" config:"allow_private_networks"`
+	// Timeouts of connecting to the external server, waiting for the response headers,
+	// fetching the whole image and resizing it. Zero means no timeout
+	ConnectTimeout time.Duration `yaml:"connectTimeout" config:"connect_timeout"`
+	HeaderTimeout  time.Duration `yaml:"headerTimeout" config:"header_timeout"`
+	FetchTimeout   time.Duration `yaml:"fetchTimeout" config:"fetch_timeout"`
+	ResizeTimeout  time.Duration `yaml:"resizeTimeout" config:"resize_timeout"`
 }
 
 func GetDefaultConfig() *Config {
 	return &Config{
-		Host:        "0.0.0.0",
-		Port:        8082,
-		LogLevel:    "debug",
-		CacheDir:    ".cache",
-		CacheSize:   10,
-		MaxFileSize: 5 * 1024 * 1024,
+		Host:                    "0.0.0.0",
+		Port:                    8082,
+		LogLevel:                "debug",
+		CacheDir:                ".cache",
+		CacheSize:               10,
+		CacheMaxBytes:           100 * 1024 * 1024,
+		CacheBackend:            "file",
+		RedisAddress:            "localhost:6379",
+		RedisPrefix:             "previewer:",
+		RedisTimeout:            5 * time.Second,
+		S3Region:                "us-east-1",
+		S3Prefix:                "previewer/",
+		S3Timeout:               30 * time.Second,
+		CacheIndexInterval:      time.Minute,
+		CacheShards:             16,
+		CacheTTL:                0,
+		CacheSweepInterval:      time.Minute,
+		MemoryCacheMaxBytes:     16 * 1024 * 1024,
+		MemoryCacheMaxItemBytes: 256 * 1024,
+		MaxFileSize:             5 * 1024 * 1024,
+		Quality:                 75,
+		MinQuality:              1,
+		MaxQuality:              100,
+		Compression:             6,
+		MinCompression:          0,
+		MaxCompression:          9,
+		WebpLossless:            false,
+		Metadata:                "strip",
+		AllowUnsafe:             false,
+		PresetsOnly:             false,
+		DefaultScheme:           "http",
+		AllowPrivateNetworks:    false,
+		ConnectTimeout:          5 * time.Second,
+		HeaderTimeout:           10 * time.Second,
+		FetchTimeout:            30 * time.Second,
+		ResizeTimeout:           30 * time.Second,
 	}
 }
 
@@ -42,6 +145,24 @@ func Read(fpath string) (config *Config, err error) {
 		)
 	}
 	err = loader.Load(context.Background(), config)
+	if err != nil {
+		return
+	}
+	err = config.Validate()
 
 	return
 }
+
+// Validate checks, that min/max ranges are consistent and contain the default values.
+func (c *Config) Validate() error {
+	if c.MinQuality > c.MaxQuality || c.Quality < c.MinQuality || c.Quality > c.MaxQuality {
+		return fmt.Errorf("%w: quality %d is not in %d-%d", ErrInvalidRange, c.Quality, c.MinQuality, c.MaxQuality)
+	}
+	if c.MinCompression > c.MaxCompression || c.Compression < c.MinCompression || c.Compression > c.MaxCompression {
+		return fmt.Errorf(
+			"%w: compression %d is not in %d-%d", ErrInvalidRange, c.Compression, c.MinCompression, c.MaxCompression,
+		)
+	}
+
+	return nil
+}
@@ -0,0 +1,25 @@
+package config
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidate(t *testing.T) {
+	require.NoError(t, GetDefaultConfig().Validate())
+
+	for name, update := range map[string]func(c *Config){
+		"min quality is greater than max": func(c *Config) { c.MinQuality, c.MaxQuality = 90, 30 },
+		"quality is out of range":         func(c *Config) { c.MaxQuality = 50 },
+		"min compression is greater than max": func(c *Config) {
+			c.MinCompression, c.MaxCompression = 9, 3
+		},
+		"compression is out of range": func(c *Config) { c.MinCompression = 7 },
+	} {
+		c := GetDefaultConfig()
+		update(c)
+		require.True(t, errors.Is(c.Validate(), ErrInvalidRange), name)
+	}
+}
@@ -0,0 +1,49 @@
+package fetcher
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/dmitryt/image-previewer/internal/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckAddress(t *testing.T) {
+	tests := map[string]bool{
+		"127.0.0.1:80":       false,
+		"[::1]:443":          false,
+		"169.254.169.254:80": false,
+		"10.1.2.3:80":        false,
+		"172.16.0.1:80":      false,
+		"192.168.1.1:8080":   false,
+		"0.0.0.0:80":         false,
+		"0.1.2.3:80":         false,
+		"100.64.0.1:80":      false,
+		"100.127.255.254:80": false,
+		"100.128.0.1:80":     true,
+		"[fd00::1]:80":       false,
+		"[fe80::1]:80":       false,
+		"93.184.216.34:80":   true,
+		"[2606:4700::1]:443": true,
+	}
+	for address, allowed := range tests {
+		err := checkAddress("tcp", address, nil)
+		if allowed {
+			require.NoError(t, err, address)
+		} else {
+			require.True(t, errors.Is(err, ErrForbiddenAddress), address)
+		}
+	}
+}
+
+func TestIsPrivateIP(t *testing.T) {
+	require.True(t, isPrivateIP(net.ParseIP("127.0.0.2")))
+	require.False(t, isPrivateIP(net.ParseIP("8.8.8.8")))
+}
+
+func TestClientIgnoresProxy(t *testing.T) {
+	client := NewHTTPClient(config.GetDefaultConfig())
+	require.Nil(t, client.Transport.(*http.Transport).Proxy)
+}
@@ -6,18 +6,23 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
+	"strings"
 
 	"github.com/dmitryt/image-previewer/internal/config"
 	"github.com/dmitryt/image-previewer/internal/utils"
 	"github.com/rs/zerolog/log"
 )
 
-var ErrResponseValidation = errors.New("unexpected status code >= 400")
+var (
+	ErrResponseValidation = errors.New("unexpected status code >= 400")
+	ErrForbiddenHost      = errors.New("external host is not allowed")
+)
 
 type Fetcher interface {
-	Fetch(string, http.Header, io.Writer) (int, string, string, error)
+	Fetch(context.Context, string, http.Header, io.Writer) (int, string, string, error)
 }
 
 type HTTPFetcher struct {
@@ -57,7 +62,12 @@ func processData(r io.Reader, w io.Writer) (mimeType string, err error) {
 			return
 		}
 		defer os.Remove(tmpFile.Name())
+		defer f.Close()
 		_, err = io.Copy(w, f)
+		// Let the reader know, that all the content was written
+		if wc, ok := w.(*io.PipeWriter); ok {
+			wc.CloseWithError(err)
+		}
 		// To handle this error need to add additional channel?
 		if err != nil {
 			log.Debug().Msgf("Err during copying  the file %s", err)
@@ -70,17 +80,74 @@ func processData(r io.Reader, w io.Writer) (mimeType string, err error) {
 	return
 }
 
-func (f *HTTPFetcher) Fetch(url string, header http.Header, w io.Writer) (statusCode int, content string, mimeType string, err error) {
+// Returns the external url with the scheme. If it's not set explicitly, it's chosen by the host rules from config.
+func (f *HTTPFetcher) buildURL(externalURL string) string {
+	lowerURL := strings.ToLower(externalURL)
+	if strings.HasPrefix(lowerURL, "http://") || strings.HasPrefix(lowerURL, "https://") {
+		return externalURL
+	}
+	host := externalURL
+	if i := strings.IndexAny(host, "/?#"); i >= 0 {
+		host = host[:i]
+	}
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	scheme := f.config.DefaultScheme
+	switch {
+	case utils.MatchAnyHost(f.config.HTTPSHosts, host):
+		scheme = "https"
+	case utils.MatchAnyHost(f.config.HTTPHosts, host):
+		scheme = "http"
+	}
+
+	return scheme + "://" + externalURL
+}
+
+// Checks the host by allowed and denied hosts from config.
+func checkHost(cfg *config.Config, host string) error {
+	if utils.MatchAnyHost(cfg.DeniedHosts, host) {
+		return fmt.Errorf("%w: %s", ErrForbiddenHost, host)
+	}
+	if len(cfg.AllowedHosts) > 0 && !utils.MatchAnyHost(cfg.AllowedHosts, host) {
+		return fmt.Errorf("%w: %s", ErrForbiddenHost, host)
+	}
+
+	return nil
+}
+
+// Checks, whether the error is caused by any of the timeouts.
+func isTimeout(err error) bool {
+	var netErr net.Error
+
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+}
+
+func (f *HTTPFetcher) Fetch(ctx context.Context, url string, header http.Header, w io.Writer) (statusCode int, content string, mimeType string, err error) {
 	statusCode = 502
-	ctx := context.Background()
-	req, err := http.NewRequestWithContext(ctx, "GET", "http://"+url, nil)
+	if f.config.FetchTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, f.config.FetchTimeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", f.buildURL(url), nil)
 	if err != nil {
 		return
 	}
+	err = checkHost(f.config, req.URL.Hostname())
+	if err != nil {
+		return http.StatusForbidden, fmt.Sprintf("%s", err), "", err
+	}
 	req.Header = header
 	resp, err := f.client.Do(req)
 	if err != nil {
 		content = fmt.Sprintf("%s", err)
+		switch {
+		case errors.Is(err, ErrForbiddenHost) || errors.Is(err, ErrForbiddenAddress):
+			statusCode = http.StatusForbidden
+		case isTimeout(err):
+			statusCode = http.StatusGatewayTimeout
+		}
 
 		return
 	}
@@ -95,6 +162,10 @@ func (f *HTTPFetcher) Fetch(url string, header http.Header, w io.Writer) (status
 	mimeType, err = processData(io.LimitReader(resp.Body, f.config.MaxFileSize), w)
 	if err != nil {
 		statusCode = 500
+		if isTimeout(err) {
+			statusCode = http.StatusGatewayTimeout
+			content = fmt.Sprintf("%s", err)
+		}
 
 		return
 	}
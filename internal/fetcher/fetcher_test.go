@@ -0,0 +1,34 @@
+package fetcher
+
+import (
+	"testing"
+
+	"github.com/dmitryt/image-previewer/internal/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildURL(t *testing.T) {
+	cfg := config.GetDefaultConfig()
+	cfg.HTTPSHosts = []string{"*.secure.com", "cdn.example.com"}
+	cfg.HTTPHosts = []string{"legacy.example.com"}
+	f := NewHTTPFetcher(nil, cfg)
+
+	tests := map[string]string{
+		"example.com/img.jpg":                 "http://example.com/img.jpg",
+		"example.com:8080/img.jpg?w=1":        "http://example.com:8080/img.jpg?w=1",
+		"https://example.com/img.jpg":         "https://example.com/img.jpg",
+		"HTTP://example.com/img.jpg":          "HTTP://example.com/img.jpg",
+		"images.secure.com/img.jpg":           "https://images.secure.com/img.jpg",
+		"cdn.example.com:8443/img.jpg":        "https://cdn.example.com:8443/img.jpg",
+		"http://images.secure.com/img.jpg":    "http://images.secure.com/img.jpg",
+		"legacy.example.com/img.jpg?size=100": "http://legacy.example.com/img.jpg?size=100",
+		"secure.com/img.jpg":                  "http://secure.com/img.jpg",
+	}
+	for externalURL, expected := range tests {
+		require.Equal(t, expected, f.buildURL(externalURL), externalURL)
+	}
+
+	cfg.DefaultScheme = "https"
+	require.Equal(t, "https://example.com/img.jpg", f.buildURL("example.com/img.jpg"))
+	require.Equal(t, "http://legacy.example.com/img.jpg", f.buildURL("legacy.example.com/img.jpg"))
+}
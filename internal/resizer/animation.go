@@ -0,0 +1,102 @@
+package resizer
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"io"
+
+	"github.com/dmitryt/image-previewer/internal/utils"
+)
+
+// resizeAnimation resizes all frames of the gif, keeping delays and loop count.
+// Gif with a single frame is processed as a regular image.
+// Resizing is stopped between frames, when the context is done.
+func resizeAnimation(ctx context.Context, r io.Reader, w io.Writer, urlParams utils.URLParams, encoder Encoder) error {
+	src, err := gif.DecodeAll(r)
+	if err != nil {
+		return err
+	}
+	if len(src.Image) == 1 {
+		resized := newTransform(src.Image[0], urlParams)(src.Image[0])
+
+		return encoder.Encode(w, resized.SubImage(resized.Rect))
+	}
+
+	result, err := resizeFrames(ctx, src, urlParams)
+	if err != nil {
+		return err
+	}
+
+	return gif.EncodeAll(w, result)
+}
+
+func resizeFrames(ctx context.Context, src *gif.GIF, urlParams utils.URLParams) (*gif.GIF, error) {
+	bounds := image.Rect(0, 0, src.Config.Width, src.Config.Height)
+	if bounds.Empty() {
+		bounds = src.Image[0].Bounds()
+	}
+	// Frames can cover only a part of the canvas, so they are composed before resizing
+	canvas := image.NewRGBA(bounds)
+	result := &gif.GIF{
+		Image:     make([]*image.Paletted, 0, len(src.Image)),
+		Delay:     make([]int, 0, len(src.Image)),
+		Disposal:  make([]byte, 0, len(src.Image)),
+		LoopCount: src.LoopCount,
+	}
+	var transform func(image.Image) *image.NRGBA
+	for i, frame := range src.Image {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		disposal := byte(0)
+		if i < len(src.Disposal) {
+			disposal = src.Disposal[i]
+		}
+		var previous *image.RGBA
+		if disposal == gif.DisposalPrevious {
+			previous = image.NewRGBA(bounds)
+			copy(previous.Pix, canvas.Pix)
+		}
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+
+		if transform == nil {
+			transform = newTransform(canvas, urlParams)
+		}
+		resized := transform(canvas)
+		paletted := image.NewPaletted(resized.Bounds(), framePalette(frame.Palette, resized))
+		draw.Draw(paletted, paletted.Rect, resized, resized.Rect.Min, draw.Src)
+
+		result.Image = append(result.Image, paletted)
+		result.Delay = append(result.Delay, src.Delay[i])
+		// Every resized frame is a complete picture, so it shouldn't be drawn over the previous one
+		result.Disposal = append(result.Disposal, gif.DisposalBackground)
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+
+	return result, nil
+}
+
+// Adds transparent color to the palette, if the frame has transparent areas.
+func framePalette(p color.Palette, img *image.NRGBA) color.Palette {
+	if img.Opaque() || len(p) >= 256 {
+		return p
+	}
+	for _, c := range p {
+		if _, _, _, a := c.RGBA(); a == 0 {
+			return p
+		}
+	}
+	result := make(color.Palette, len(p), len(p)+1)
+	copy(result, p)
+
+	return append(result, color.Transparent)
+}
@@ -0,0 +1,82 @@
+package resizer
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/gif"
+	"testing"
+
+	"github.com/dmitryt/image-previewer/internal/utils"
+	"github.com/stretchr/testify/require"
+)
+
+var animationPalette = color.Palette{
+	color.Transparent,
+	color.RGBA{R: 255, A: 255},
+	color.RGBA{G: 255, A: 255},
+	color.RGBA{B: 255, A: 255},
+}
+
+// Creates the animation, where every frame after the first one covers only a part of the canvas.
+func animatedGif(t *testing.T) []byte {
+	src := &gif.GIF{
+		Config:    image.Config{ColorModel: animationPalette, Width: 200, Height: 100},
+		LoopCount: 3,
+	}
+	for i, rect := range []image.Rectangle{
+		image.Rect(0, 0, 200, 100),
+		image.Rect(50, 25, 150, 75),
+		image.Rect(0, 0, 100, 100),
+	} {
+		frame := image.NewPaletted(rect, animationPalette)
+		for j := range frame.Pix {
+			frame.Pix[j] = uint8(i + 1)
+		}
+		src.Image = append(src.Image, frame)
+		src.Delay = append(src.Delay, 10*(i+1))
+		src.Disposal = append(src.Disposal, gif.DisposalNone)
+	}
+	buf := &bytes.Buffer{}
+	require.NoError(t, gif.EncodeAll(buf, src))
+
+	return buf.Bytes()
+}
+
+func TestResizeAnimation(t *testing.T) {
+	t.Run("should resize all frames", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		up := utils.URLParams{Method: "fill", Width: 50, Height: 50}
+		err := resizeAnimation(context.Background(), bytes.NewReader(animatedGif(t)), buf, up, GifEncoder{})
+		require.NoError(t, err)
+
+		result, err := gif.DecodeAll(buf)
+		require.NoError(t, err)
+		require.Len(t, result.Image, 3)
+		require.Equal(t, []int{10, 20, 30}, result.Delay)
+		require.Equal(t, 3, result.LoopCount)
+		for _, frame := range result.Image {
+			require.Equal(t, image.Rect(0, 0, 50, 50), frame.Bounds())
+		}
+		// Second frame covers only the center of the canvas, the rest is taken from the first one
+		second := result.Image[1]
+		require.Equal(t, color.RGBA{G: 255, A: 255}, color.RGBAModel.Convert(second.At(25, 25)))
+		require.Equal(t, color.RGBA{R: 255, A: 255}, color.RGBAModel.Convert(second.At(25, 2)))
+	})
+
+	t.Run("should keep single frame gif as a regular image", func(t *testing.T) {
+		src := &bytes.Buffer{}
+		img := image.NewPaletted(image.Rect(0, 0, 200, 100), animationPalette)
+		require.NoError(t, gif.Encode(src, img, nil))
+
+		buf := &bytes.Buffer{}
+		up := utils.URLParams{Method: "fit", Width: 50, Height: 50}
+		require.NoError(t, resizeAnimation(context.Background(), src, buf, up, GifEncoder{}))
+
+		result, err := gif.DecodeAll(buf)
+		require.NoError(t, err)
+		require.Len(t, result.Image, 1)
+		require.Equal(t, image.Rect(0, 0, 50, 25), result.Image[0].Bounds())
+	})
+}
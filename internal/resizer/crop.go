@@ -0,0 +1,47 @@
+package resizer
+
+import (
+	"image"
+	"math"
+)
+
+// cropSize returns the biggest size with the aspect ratio of width/height, which fits into bounds.
+func cropSize(bounds image.Rectangle, width, height int) (int, int) {
+	scale := math.Min(float64(bounds.Dx())/float64(width), float64(bounds.Dy())/float64(height))
+	cropWidth := clamp(int(math.Round(float64(width)*scale)), 1, bounds.Dx())
+	cropHeight := clamp(int(math.Round(float64(height)*scale)), 1, bounds.Dy())
+
+	return cropWidth, cropHeight
+}
+
+// focusCrop returns the crop window with the aspect ratio of width/height, centered at the focal point.
+// Focal point coordinates are set in percents of the image size.
+func focusCrop(img image.Image, width, height int, focusX, focusY float64) image.Rectangle {
+	bounds := img.Bounds()
+	cropWidth, cropHeight := cropSize(bounds, width, height)
+	centerX := int(math.Round(float64(bounds.Dx()) * focusX / 100))
+	centerY := int(math.Round(float64(bounds.Dy()) * focusY / 100))
+	x := bounds.Min.X + clamp(centerX-cropWidth/2, 0, bounds.Dx()-cropWidth)
+	y := bounds.Min.Y + clamp(centerY-cropHeight/2, 0, bounds.Dy()-cropHeight)
+
+	return image.Rect(x, y, x+cropWidth, y+cropHeight)
+}
+
+func clamp(v, min, max int) int {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+
+	return v
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+
+	return v
+}
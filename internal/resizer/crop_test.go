@@ -0,0 +1,66 @@
+package resizer
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Creates the image, where only the given rectangle contains details.
+func detailedImage(width, height int, details image.Rectangle) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := color.NRGBA{R: 128, G: 128, B: 128, A: 255}
+			if (image.Point{X: x, Y: y}).In(details) {
+				v := uint8((x*31 + y*17) % 256)
+				c = color.NRGBA{R: v, G: 255 - v, B: v / 2, A: 255}
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+
+	return img
+}
+
+func TestSmartCrop(t *testing.T) {
+	t.Run("should pick the detailed area horizontally", func(t *testing.T) {
+		img := detailedImage(400, 100, image.Rect(300, 0, 400, 100))
+		rect := smartCrop(img, 100, 100)
+		require.Equal(t, 100, rect.Dx())
+		require.Equal(t, 100, rect.Dy())
+		require.Equal(t, 300, rect.Min.X)
+	})
+
+	t.Run("should pick the detailed area vertically", func(t *testing.T) {
+		img := detailedImage(100, 400, image.Rect(0, 50, 100, 150))
+		rect := smartCrop(img, 100, 100)
+		require.Equal(t, image.Rect(0, 50, 100, 150), rect)
+	})
+
+	t.Run("should prefer the center for uniform images", func(t *testing.T) {
+		img := detailedImage(400, 100, image.Rectangle{})
+		rect := smartCrop(img, 100, 100)
+		require.Equal(t, image.Rect(150, 0, 250, 100), rect)
+	})
+
+	t.Run("should not crop, if aspect ratio is the same", func(t *testing.T) {
+		img := detailedImage(200, 100, image.Rectangle{})
+		require.Equal(t, img.Bounds(), smartCrop(img, 100, 50))
+	})
+}
+
+func TestFocusCrop(t *testing.T) {
+	img := detailedImage(400, 100, image.Rectangle{})
+
+	t.Run("should center the window at the focal point", func(t *testing.T) {
+		require.Equal(t, image.Rect(50, 0, 150, 100), focusCrop(img, 100, 100, 25, 50))
+	})
+
+	t.Run("should keep the window inside the image", func(t *testing.T) {
+		require.Equal(t, image.Rect(0, 0, 100, 100), focusCrop(img, 100, 100, 0, 0))
+		require.Equal(t, image.Rect(300, 0, 400, 100), focusCrop(img, 100, 100, 100, 100))
+	})
+}
@@ -6,38 +6,76 @@ import (
 	"image/jpeg"
 	"image/png"
 	"io"
+
+	"github.com/chai2010/webp"
 )
 
 type Encoder interface {
 	Encode(io.Writer, image.Image) error
 }
 
+type EncoderOptions struct {
+	// Quality of lossy formats, 1-100
+	Quality int
+	// Compression level of png, 0-9
+	Compression int
+	// Use lossless compression for webp
+	Lossless bool
+}
+
 type (
-	JpegEncoder struct{}
-	PngEncoder  struct{}
+	JpegEncoder struct {
+		options *jpeg.Options
+	}
+	PngEncoder struct {
+		encoder *png.Encoder
+	}
 	GifEncoder  struct{}
+	WebpEncoder struct {
+		options *webp.Options
+	}
 )
 
 func (r JpegEncoder) Encode(w io.Writer, img image.Image) error {
-	return jpeg.Encode(w, img, nil)
+	return jpeg.Encode(w, img, r.options)
 }
 
 func (r PngEncoder) Encode(w io.Writer, img image.Image) error {
-	return png.Encode(w, img)
+	return r.encoder.Encode(w, img)
 }
 
 func (r GifEncoder) Encode(w io.Writer, img image.Image) error {
 	return gif.Encode(w, img, nil)
 }
 
-func NewEncoder(contentType string) Encoder {
+func (r WebpEncoder) Encode(w io.Writer, img image.Image) error {
+	return webp.Encode(w, img, r.options)
+}
+
+// Maps zlib-like compression level to the one, which is supported by png package.
+func pngCompressionLevel(level int) png.CompressionLevel {
+	switch {
+	case level <= 0:
+		return png.NoCompression
+	case level <= 3:
+		return png.BestSpeed
+	case level <= 6:
+		return png.DefaultCompression
+	default:
+		return png.BestCompression
+	}
+}
+
+func NewEncoder(contentType string, options EncoderOptions) Encoder {
 	switch contentType {
 	case "image/jpeg":
-		return JpegEncoder{}
+		return JpegEncoder{options: &jpeg.Options{Quality: options.Quality}}
 	case "image/png":
-		return PngEncoder{}
+		return PngEncoder{encoder: &png.Encoder{CompressionLevel: pngCompressionLevel(options.Compression)}}
 	case "image/gif":
 		return GifEncoder{}
+	case "image/webp":
+		return WebpEncoder{options: &webp.Options{Quality: float32(options.Quality), Lossless: options.Lossless}}
 	default:
 		return nil
 	}
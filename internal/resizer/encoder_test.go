@@ -0,0 +1,37 @@
+package resizer
+
+import (
+	"bytes"
+	"image"
+	"net/http"
+	"testing"
+
+	"github.com/dmitryt/image-previewer/internal/utils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebpEncoder(t *testing.T) {
+	img := detailedImage(200, 100, image.Rect(0, 0, 100, 100))
+
+	for _, options := range []EncoderOptions{{Quality: 80}, {Lossless: true}} {
+		buf := &bytes.Buffer{}
+		encoder := NewEncoder("image/webp", options)
+		require.NotNil(t, encoder)
+		require.NoError(t, encoder.Encode(buf, img))
+		require.Equal(t, "image/webp", http.DetectContentType(buf.Bytes()))
+
+		// Encoded image should be decoded back by resizer
+		resized, err := resize(bytes.NewReader(buf.Bytes()), utils.URLParams{Method: "fill", Width: 50, Height: 50})
+		require.NoError(t, err)
+		require.Equal(t, image.Rect(0, 0, 50, 50), resized.Bounds())
+	}
+}
+
+func TestJpegQuality(t *testing.T) {
+	img := detailedImage(200, 100, image.Rect(0, 0, 200, 100))
+	low, high := &bytes.Buffer{}, &bytes.Buffer{}
+
+	require.NoError(t, NewEncoder("image/jpeg", EncoderOptions{Quality: 10}).Encode(low, img))
+	require.NoError(t, NewEncoder("image/jpeg", EncoderOptions{Quality: 95}).Encode(high, img))
+	require.Less(t, low.Len(), high.Len())
+}
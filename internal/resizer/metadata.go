@@ -0,0 +1,181 @@
+package resizer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+const (
+	jpegMarkerSOS  = 0xDA
+	jpegMarkerAPP1 = 0xE1
+	jpegMarkerAPP2 = 0xE2
+	tiffTypeASCII  = 2
+)
+
+var (
+	exifHeader = []byte("Exif\x00\x00")
+	iccHeader  = []byte("ICC_PROFILE\x00")
+	// EXIF tags, which are safe to keep. Orientation is not kept, because it's applied to the image.
+	safeExifTags = map[uint16]bool{
+		0x010E: true, // ImageDescription
+		0x013B: true, // Artist
+		0x8298: true, // Copyright
+	}
+)
+
+// safeMetadata extracts ICC profile and safe EXIF fields from the jpeg and returns them as jpeg segments.
+func safeMetadata(data []byte) []byte {
+	result := &bytes.Buffer{}
+	for _, segment := range jpegSegments(data) {
+		if len(segment) < 4 {
+			continue
+		}
+		marker, payload := segment[1], segment[4:]
+		switch {
+		case marker == jpegMarkerAPP2 && bytes.HasPrefix(payload, iccHeader):
+			result.Write(segment)
+		case marker == jpegMarkerAPP1 && bytes.HasPrefix(payload, exifHeader):
+			exif := safeExif(payload[len(exifHeader):])
+			if exif != nil {
+				writeJpegSegment(result, jpegMarkerAPP1, append(append([]byte{}, exifHeader...), exif...))
+			}
+		}
+	}
+
+	return result.Bytes()
+}
+
+// jpegSegments returns the raw segments (with markers), which are placed before the image data.
+func jpegSegments(data []byte) (result [][]byte) {
+	if len(data) < 2 || data[0] != 0xFF || data[1] != 0xD8 {
+		return
+	}
+	for i := 2; i+4 <= len(data) && data[i] == 0xFF; {
+		marker := data[i+1]
+		if marker == jpegMarkerSOS {
+			return
+		}
+		// Length includes its own 2 bytes, smaller values mean the broken jpeg
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if length < 2 {
+			return
+		}
+		end := i + 2 + length
+		if end > len(data) {
+			return
+		}
+		result = append(result, data[i:end])
+		i = end
+	}
+
+	return
+}
+
+func writeJpegSegment(w *bytes.Buffer, marker byte, payload []byte) {
+	w.Write([]byte{0xFF, marker})
+	_ = binary.Write(w, binary.BigEndian, uint16(len(payload)+2))
+	w.Write(payload)
+}
+
+// safeExif parses the first IFD of the TIFF structure and builds the new one only with safe ASCII tags.
+func safeExif(tiff []byte) []byte {
+	if len(tiff) < 8 {
+		return nil
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil
+	}
+	offset := int(order.Uint32(tiff[4:]))
+	if offset+2 > len(tiff) {
+		return nil
+	}
+	count := int(order.Uint16(tiff[offset:]))
+	tags := make(map[uint16][]byte)
+	keys := make([]uint16, 0)
+	for i := 0; i < count; i++ {
+		entry := offset + 2 + i*12
+		if entry+12 > len(tiff) {
+			break
+		}
+		tag, typ, size := order.Uint16(tiff[entry:]), order.Uint16(tiff[entry+2:]), int(order.Uint32(tiff[entry+4:]))
+		if !safeExifTags[tag] || typ != tiffTypeASCII {
+			continue
+		}
+		value := tiff[entry+8 : entry+12]
+		if size > 4 {
+			start := int(order.Uint32(tiff[entry+8:]))
+			if start+size > len(tiff) {
+				continue
+			}
+			value = tiff[start : start+size]
+		}
+		tags[tag] = value[:size]
+		keys = append(keys, tag)
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	// Header, IFD with entries sorted by tag (as they are in the source) and values after it
+	result := &bytes.Buffer{}
+	result.WriteString("II*\x00")
+	_ = binary.Write(result, binary.LittleEndian, uint32(8))
+	_ = binary.Write(result, binary.LittleEndian, uint16(len(keys)))
+	dataOffset := 8 + 2 + len(keys)*12 + 4
+	values := &bytes.Buffer{}
+	for _, tag := range keys {
+		value := tags[tag]
+		_ = binary.Write(result, binary.LittleEndian, tag)
+		_ = binary.Write(result, binary.LittleEndian, uint16(tiffTypeASCII))
+		_ = binary.Write(result, binary.LittleEndian, uint32(len(value)))
+		if len(value) <= 4 {
+			result.Write(append(append([]byte{}, value...), make([]byte, 4-len(value))...))
+
+			continue
+		}
+		_ = binary.Write(result, binary.LittleEndian, uint32(dataOffset+values.Len()))
+		values.Write(value)
+	}
+	_ = binary.Write(result, binary.LittleEndian, uint32(0))
+	result.Write(values.Bytes())
+
+	return result.Bytes()
+}
+
+// metadataWriter inserts metadata segments right after the SOI marker of the jpeg.
+type metadataWriter struct {
+	w        io.Writer
+	metadata []byte
+	written  int
+}
+
+func (m *metadataWriter) Write(p []byte) (n int, err error) {
+	if m.written >= 2 || len(p) == 0 {
+		return m.w.Write(p)
+	}
+	head := 2 - m.written
+	if head > len(p) {
+		head = len(p)
+	}
+	n, err = m.w.Write(p[:head])
+	m.written += n
+	if err != nil {
+		return
+	}
+	if m.written == 2 {
+		_, err = m.w.Write(m.metadata)
+		if err != nil {
+			return
+		}
+	}
+	rest, err := m.Write(p[head:])
+
+	return n + rest, err
+}
@@ -0,0 +1,116 @@
+package resizer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dmitryt/image-previewer/internal/config"
+	"github.com/dmitryt/image-previewer/internal/utils"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func init() {
+	zerolog.SetGlobalLevel(zerolog.InfoLevel)
+}
+
+func isRed(c color.Color) bool {
+	r, g, b, _ := c.RGBA()
+
+	return r > 0xC000 && g < 0x4000 && b < 0x4000
+}
+
+func isWhite(c color.Color) bool {
+	r, g, b, _ := c.RGBA()
+
+	return r > 0xC000 && g > 0xC000 && b > 0xC000
+}
+
+func TestOrientation(t *testing.T) {
+	// All fixtures contain the same 60x30 image with the red top left corner, stored with different orientations
+	for orientation := 1; orientation <= 8; orientation++ {
+		f, err := os.Open(filepath.Join("testdata", fmt.Sprintf("orientation_%d.jpg", orientation)))
+		require.NoError(t, err)
+		img, err := resize(f, utils.URLParams{Method: "fit", Width: 60, Height: 60})
+		f.Close()
+		require.NoError(t, err)
+
+		require.Equal(t, image.Rect(0, 0, 60, 30), img.Bounds(), "orientation %d", orientation)
+		require.True(t, isRed(img.At(5, 3)), "orientation %d", orientation)
+		require.True(t, isWhite(img.At(55, 3)), "orientation %d", orientation)
+		require.True(t, isWhite(img.At(5, 25)), "orientation %d", orientation)
+		require.True(t, isWhite(img.At(55, 25)), "orientation %d", orientation)
+	}
+}
+
+func TestSafeMetadata(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "orientation_6.jpg"))
+	require.NoError(t, err)
+
+	segments := jpegSegments(append([]byte{0xFF, 0xD8}, safeMetadata(data)...))
+	require.Len(t, segments, 2)
+	// Only copyright is kept from EXIF, orientation and GPS are removed
+	require.Equal(t, byte(jpegMarkerAPP1), segments[0][1])
+	exif := segments[0][4+len(exifHeader):]
+	require.Contains(t, string(exif), "Gopher")
+	require.Equal(t, uint16(1), uint16(exif[8])|uint16(exif[9])<<8)
+	require.Equal(t, byte(jpegMarkerAPP2), segments[1][1])
+	require.True(t, bytes.Contains(segments[1], []byte("fake icc profile")))
+}
+
+func TestBrokenMetadata(t *testing.T) {
+	for _, data := range [][]byte{
+		{0xFF, 0xD8, 0xFF, 0xE1, 0x00, 0x00, 0xFF, 0xE1},
+		{0xFF, 0xD8, 0xFF, 0xE1, 0x00, 0x01, 0x45},
+		{0xFF, 0xD8, 0xFF, 0xE1, 0x00, 0x02},
+		{0xFF, 0xD8, 0xFF, 0xE1, 0x00, 0x08, 'E', 'x', 'i', 'f', 0x00, 0x00},
+	} {
+		require.NotPanics(t, func() {
+			require.Empty(t, safeMetadata(data))
+		}, "% x", data)
+	}
+}
+
+func TestMetadataMode(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "metadata")
+	require.NoError(t, err)
+	defer os.RemoveAll(cacheDir)
+
+	cfg := config.GetDefaultConfig()
+	cfg.CacheDir = cacheDir
+	r, err := New(cfg)
+	require.NoError(t, err)
+
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "orientation_6.jpg"))
+	require.NoError(t, err)
+
+	for mode, expected := range map[string]int{"strip": 0, "keep": 2} {
+		up := utils.URLParams{Method: "fit", Width: 30, Height: 30, Metadata: mode}
+		require.NoError(t, r.ResizeAndSave(context.Background(), bytes.NewReader(data), up, "image/jpeg"))
+
+		f, _, err := r.Open(up)
+		require.NoError(t, err)
+		result, err := ioutil.ReadAll(f)
+		f.Close()
+		require.NoError(t, err)
+
+		metadata := 0
+		for _, segment := range jpegSegments(result) {
+			if segment[1] == jpegMarkerAPP1 || segment[1] == jpegMarkerAPP2 {
+				metadata++
+			}
+		}
+		require.Equal(t, expected, metadata, "incorrect metadata for %s", mode)
+
+		img, _, err := image.Decode(bytes.NewReader(result))
+		require.NoError(t, err, "result should be valid jpeg")
+		require.Equal(t, image.Rect(0, 0, 30, 15), img.Bounds())
+	}
+}
@@ -1,12 +1,15 @@
 package resizer
 
 import (
+	"bytes"
+	"context"
 	"crypto/sha512"
 	"errors"
 	"fmt"
 	"image"
 	"io"
-	"os"
+	"io/ioutil"
+	"math"
 
 	"github.com/disintegration/imaging"
 	"github.com/dmitryt/image-previewer/internal/cache"
@@ -16,80 +19,338 @@ import (
 )
 
 type Resizer struct {
-	cache cache.Cache
+	config *config.Config
+	cache  cache.Cache
+	// Small popular files are kept in memory, it's nil if it's disabled
+	hot *cache.MemoryCache
 }
 
 var (
 	ErrInvalidURI          = errors.New("invalid URI. Expected format is: /<method>/<width>/<height>/<external url>")
 	ErrRequestValidation   = errors.New("request validation error occurred")
 	ErrCacheFile           = errors.New("problem with cache file occurred")
-	ErrUnsupportedFileType = errors.New("file type is not supported. Supported file types: jpeg, png, gif")
+	ErrUnsupportedFileType = errors.New("file type is not supported. Supported file types: jpeg, png, gif, webp")
+	ErrUnknownCacheBackend = errors.New("unknown cache backend")
+	ErrOptionOutOfRange    = errors.New("option value is out of the allowed range")
 )
 
+var anchors = map[string]imaging.Anchor{
+	"center":      imaging.Center,
+	"top":         imaging.Top,
+	"bottom":      imaging.Bottom,
+	"left":        imaging.Left,
+	"right":       imaging.Right,
+	"topleft":     imaging.TopLeft,
+	"topright":    imaging.TopRight,
+	"bottomleft":  imaging.BottomLeft,
+	"bottomright": imaging.BottomRight,
+}
+
 func New(c *config.Config) (*Resizer, error) {
-	ch, err := cache.New(c.CacheSize, c.CacheDir)
+	var ch cache.Cache
+	var err error
+	switch c.CacheBackend {
+	case "file":
+		ch, err = cache.New(c.CacheDir, cache.Options{
+			Capacity:      c.CacheSize,
+			MaxBytes:      c.CacheMaxBytes,
+			IndexInterval: c.CacheIndexInterval,
+			TTL:           c.CacheTTL,
+			SweepInterval: c.CacheSweepInterval,
+			Shards:        c.CacheShards,
+		})
+	case "redis":
+		ch, err = cache.NewRedis(cache.RedisOptions{
+			Address:  c.RedisAddress,
+			Password: c.RedisPassword,
+			DB:       c.RedisDB,
+			Prefix:   c.RedisPrefix,
+			TTL:      c.CacheTTL,
+			Timeout:  c.RedisTimeout,
+		})
+	case "s3":
+		ch, err = cache.NewS3(cache.S3Options{
+			Endpoint:  c.S3Endpoint,
+			Region:    c.S3Region,
+			Bucket:    c.S3Bucket,
+			Prefix:    c.S3Prefix,
+			AccessKey: c.S3AccessKey,
+			SecretKey: c.S3SecretKey,
+			TTL:       c.CacheTTL,
+			Timeout:   c.S3Timeout,
+		})
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownCacheBackend, c.CacheBackend)
+	}
+	var hot *cache.MemoryCache
+	if c.MemoryCacheMaxBytes > 0 {
+		hot = cache.NewMemoryCache(c.MemoryCacheMaxBytes, c.MemoryCacheMaxItemBytes, c.CacheTTL)
+	}
 
-	return &Resizer{cache: ch}, err
+	return &Resizer{config: c, cache: ch, hot: hot}, err
+}
+
+// Close saves the state of the cache.
+func (r *Resizer) Close() error {
+	return r.cache.Close()
 }
 
 func resize(r io.Reader, urlParams utils.URLParams) (result *image.NRGBA, err error) {
-	img, _, err := image.Decode(r)
+	// EXIF orientation is applied, so photos are not rotated
+	img, err := imaging.Decode(r, imaging.AutoOrientation(true))
 	if err != nil {
 		return
 	}
-	result = imaging.Fill(img, urlParams.Width, urlParams.Height, imaging.Center, imaging.Lanczos)
+	result = newTransform(img, urlParams)(img)
 
 	return
 }
 
+// newTransform returns the function, which resizes images according to URL params.
+// Crop window is calculated once for the given image, so all frames of an animation are cropped the same way.
+func newTransform(img image.Image, urlParams utils.URLParams) func(image.Image) *image.NRGBA {
+	width, height := urlParams.Width, urlParams.Height
+	// Zero width or height means the missing dimension is calculated from the aspect ratio
+	if width == 0 || height == 0 || urlParams.Method == "resize" {
+		return func(img image.Image) *image.NRGBA {
+			return imaging.Resize(img, width, height, imaging.Lanczos)
+		}
+	}
+	if urlParams.Method == "fit" {
+		return func(img image.Image) *image.NRGBA {
+			return imaging.Fit(img, width, height, imaging.Lanczos)
+		}
+	}
+
+	var rect image.Rectangle
+	switch urlParams.Gravity {
+	case "smart":
+		rect = smartCrop(img, width, height)
+		log.Debug().Msgf("smart crop rectangle %s", rect)
+	case "focus":
+		rect = focusCrop(img, width, height, urlParams.FocusX, urlParams.FocusY)
+		log.Debug().Msgf("focus crop rectangle %s", rect)
+	}
+	anchor, ok := anchors[urlParams.Gravity]
+	if !ok {
+		anchor = imaging.Center
+	}
+
+	return func(img image.Image) *image.NRGBA {
+		if !rect.Empty() {
+			img = imaging.Crop(img, rect)
+		}
+
+		return imaging.Fill(img, width, height, anchor, imaging.Lanczos)
+	}
+}
+
+// Returns encoder options from URL params, falling back to config defaults.
+func (r *Resizer) encoderOptions(up utils.URLParams) EncoderOptions {
+	quality := r.config.Quality
+	if up.Quality != 0 {
+		quality = up.Quality
+	}
+	compression := r.config.Compression
+	if up.Compression != nil {
+		compression = *up.Compression
+	}
+
+	return EncoderOptions{
+		Quality:     clamp(quality, r.config.MinQuality, r.config.MaxQuality),
+		Compression: clamp(compression, r.config.MinCompression, r.config.MaxCompression),
+		Lossless:    r.config.WebpLossless,
+	}
+}
+
+// Validate checks, that quality and compression from URL params are in the ranges, which are allowed by config.
+func (r *Resizer) Validate(up utils.URLParams) error {
+	if up.Quality != 0 && (up.Quality < r.config.MinQuality || up.Quality > r.config.MaxQuality) {
+		return fmt.Errorf("%w quality:%d, allowed %d-%d", ErrOptionOutOfRange, up.Quality, r.config.MinQuality, r.config.MaxQuality)
+	}
+	if up.Compression != nil && (*up.Compression < r.config.MinCompression || *up.Compression > r.config.MaxCompression) {
+		return fmt.Errorf(
+			"%w compression:%d, allowed %d-%d",
+			ErrOptionOutOfRange, *up.Compression, r.config.MinCompression, r.config.MaxCompression,
+		)
+	}
+
+	return nil
+}
+
+// Marks the option, which isn't used by the output format, in the cache key.
+const unusedOption = math.MinInt32
+
+// Returns quality and compression, which can affect the output, unusedOption means the option isn't used
+// by the output format. If the format isn't known before the source is fetched, both options are returned.
+// Compression is the level of png encoder, so the values, which give the same output, share the key.
+func (r *Resizer) keyOptions(up utils.URLParams) (quality, compression int) {
+	options := r.encoderOptions(up)
+	quality, compression = options.Quality, int(pngCompressionLevel(options.Compression))
+	format := up.Format
+	if format == "" {
+		format = up.AcceptFormat
+	}
+	switch format {
+	case "jpeg", "webp":
+		return quality, unusedOption
+	case "png":
+		return unusedOption, compression
+	case "gif":
+		return unusedOption, unusedOption
+	}
+
+	return quality, compression
+}
+
+// Returns the way of processing the metadata: "strip" or "keep".
+func (r *Resizer) metadataMode(up utils.URLParams) string {
+	if up.Metadata != "" {
+		return up.Metadata
+	}
+
+	return r.config.Metadata
+}
+
 // Made it public just for testing purposes.
 func (r *Resizer) GetCacheKey(up utils.URLParams) cache.Key {
 	h := sha512.New()
-	str := fmt.Sprintf("%s/%dx%d", up.ExternalURL, up.Width, up.Height)
+	quality, compression := r.keyOptions(up)
+	str := fmt.Sprintf(
+		"%s/%s/%dx%d/%s/%gx%g/%s/%s/q%d/c%d/%t/%s",
+		up.Method, up.ExternalURL, up.Width, up.Height, up.Gravity, up.FocusX, up.FocusY, up.Format, up.AcceptFormat,
+		quality, compression, up.FirstFrame, r.metadataMode(up),
+	)
 	_, _ = io.WriteString(h, str)
 	result := cache.Key([]rune(fmt.Sprintf("%x", h.Sum(nil)))[0:64])
 
 	return result
 }
 
-func (r *Resizer) GetFile(urlParams utils.URLParams) (fd *os.File, mimeType string, err error) {
-	fd, err = r.cache.GetFile(r.GetCacheKey(urlParams), os.O_RDONLY)
+// Open returns the content of the cached file and its type.
+func (r *Resizer) Open(urlParams utils.URLParams) (io.ReadCloser, cache.Meta, error) {
+	return r.cache.Open(r.GetCacheKey(urlParams))
+}
+
+// GetBytes returns the content of the file, if it's small enough to be kept in memory.
+// Files are promoted to memory on access, and removed from it, when they are not used recently.
+func (r *Resizer) GetBytes(urlParams utils.URLParams) (data []byte, mimeType string, found bool) {
+	if r.hot == nil {
+		return nil, "", false
+	}
+	cacheKey := r.GetCacheKey(urlParams)
+	if entry, ok := r.hot.Get(cacheKey); ok {
+		return entry.Data, entry.ContentType, true
+	}
+	// File can be written again while it's read, then the read content isn't promoted
+	version := r.hot.Version()
+	content, meta, err := r.cache.Open(cacheKey)
 	if err != nil {
-		return
+		return nil, "", false
+	}
+	defer content.Close()
+	if !r.hot.Fits(meta.Size) {
+		return nil, "", false
+	}
+	data, err = ioutil.ReadAll(content)
+	if err != nil {
+		return nil, "", false
+	}
+	if r.hot.Promote(cacheKey, cache.Entry{Data: data, ContentType: meta.ContentType}, version) {
+		log.Debug().Msgf("file %s was promoted to memory", cacheKey)
 	}
-	mimeType, err = utils.GetFileMimeType(fd)
 
-	return
+	return data, meta.ContentType, true
 }
 
 func (r *Resizer) HasFile(urlParams utils.URLParams) bool {
-	cacheKey := r.GetCacheKey(urlParams)
-	_, found := r.cache.Get(cacheKey)
-
-	return found && r.cache.HasFilePath(cacheKey)
+	return r.cache.Has(r.GetCacheKey(urlParams))
 }
 
-func (r *Resizer) ResizeAndSave(rd io.Reader, urlParams utils.URLParams, mimeType string) (err error) {
+func (r *Resizer) ResizeAndSave(ctx context.Context, rd io.Reader, urlParams utils.URLParams, mimeType string) (err error) {
 	cacheKey := r.GetCacheKey(urlParams)
-	encoder := NewEncoder(mimeType)
-	if encoder == nil {
+	// Output format is the same as the source one, unless it's set explicitly or preferred by the client
+	outputType := mimeType
+	switch {
+	case urlParams.Format != "":
+		outputType = utils.Formats[urlParams.Format]
+	// Only the first frame would be kept, so animations are not converted to the preferred format
+	case urlParams.AcceptFormat != "" && (mimeType != "image/gif" || urlParams.FirstFrame):
+		outputType = utils.Formats[urlParams.AcceptFormat]
+	}
+	options := r.encoderOptions(urlParams)
+	encoder := NewEncoder(outputType, options)
+	if encoder == nil || NewEncoder(mimeType, options) == nil {
 		return ErrUnsupportedFileType
 	}
-	_, err = r.cache.Set(cacheKey, string(cacheKey))
+	// File is added to the cache only when it's written completely, so partial files are never served
+	f, err := r.cache.Create(cacheKey, outputType)
 	if err != nil {
 		return
 	}
-	f, err := r.cache.GetFile(cacheKey, os.O_APPEND|os.O_WRONLY)
+
+	if r.config.ResizeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.config.ResizeTimeout)
+		defer cancel()
+	}
+	// Decoding and encoding can't be interrupted, so resizing is done in background. If the context is done,
+	// it's stopped on the next read, write or frame, and only then the written content is discarded.
+	done := make(chan error, 1)
+	go func() {
+		done <- r.resizeTo(ctx, f, rd, urlParams, mimeType, outputType, encoder)
+	}()
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+		log.Debug().Msgf("resizing was interrupted, err: %s", err)
+		go func() {
+			<-done
+			f.Abort()
+		}()
+
+		return
+	}
 	if err != nil {
+		f.Abort()
+
+		return
+	}
+	err = f.Commit()
+	// Previous version of the file (e.g. expired one) shouldn't be served from memory
+	if r.hot != nil {
+		r.hot.Remove(cacheKey)
+	}
+
+	return
+}
+
+func (r *Resizer) resizeTo(
+	ctx context.Context, w io.Writer, rd io.Reader, urlParams utils.URLParams, mimeType, outputType string, encoder Encoder,
+) (err error) {
+	w, rd = ctxWriter{ctx: ctx, w: w}, ctxReader{ctx: ctx, r: rd}
+	if mimeType == "image/gif" && outputType == "image/gif" && !urlParams.FirstFrame {
+		err = resizeAnimation(ctx, rd, w, urlParams, encoder)
+		log.Debug().Msgf("resizing animation, err: %s", err)
+
 		return
 	}
-	defer f.Close()
+	// Safe metadata can be kept only between jpeg images
+	if r.metadataMode(urlParams) == "keep" && mimeType == "image/jpeg" && outputType == "image/jpeg" {
+		data, errRead := ioutil.ReadAll(rd)
+		if errRead != nil {
+			return errRead
+		}
+		rd = bytes.NewReader(data)
+		w = &metadataWriter{w: w, metadata: safeMetadata(data)}
+	}
 	resized, err := resize(rd, urlParams)
 	log.Debug().Msgf("resizing, err: %s", err)
 	if err != nil {
 		return
 	}
-	err = encoder.Encode(f, resized.SubImage(resized.Rect))
+	err = encoder.Encode(w, resized.SubImage(resized.Rect))
 	log.Debug().Msgf("encoding, err: %s", err)
 
 	return
@@ -0,0 +1,267 @@
+package resizer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/jpeg"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/dmitryt/image-previewer/internal/cache"
+	"github.com/dmitryt/image-previewer/internal/config"
+	"github.com/dmitryt/image-previewer/internal/utils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResizeAndSaveFailure(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "resizer")
+	require.NoError(t, err)
+	defer os.RemoveAll(cacheDir)
+
+	cfg := config.GetDefaultConfig()
+	cfg.CacheDir = cacheDir
+	r, err := New(cfg)
+	require.NoError(t, err)
+
+	up := utils.URLParams{Method: "fill", Width: 30, Height: 30}
+	err = r.ResizeAndSave(context.Background(), strings.NewReader("not an image"), up, "image/jpeg")
+	require.Error(t, err)
+
+	// Neither the cache file, nor the temp one are left
+	require.False(t, r.HasFile(up))
+	files, err := ioutil.ReadDir(cacheDir)
+	require.NoError(t, err)
+	require.Empty(t, files)
+}
+
+// Endless source, which is read slowly.
+type slowReader struct {
+	reads int32
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	atomic.AddInt32(&r.reads, 1)
+	time.Sleep(5 * time.Millisecond)
+	p[0] = 0xff
+
+	return 1, nil
+}
+
+func TestResizeTimeout(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "resizer")
+	require.NoError(t, err)
+	defer os.RemoveAll(cacheDir)
+
+	cfg := config.GetDefaultConfig()
+	cfg.CacheDir = cacheDir
+	cfg.ResizeTimeout = 30 * time.Millisecond
+	r, err := New(cfg)
+	require.NoError(t, err)
+	defer r.Close()
+
+	up := utils.URLParams{Method: "fill", Width: 30, Height: 30}
+	rd := &slowReader{}
+	err = r.ResizeAndSave(context.Background(), rd, up, "image/jpeg")
+	require.True(t, errors.Is(err, context.DeadlineExceeded))
+
+	// Resizing is stopped in background, and the source isn't read anymore
+	time.Sleep(20 * time.Millisecond)
+	reads := atomic.LoadInt32(&rd.reads)
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, reads, atomic.LoadInt32(&rd.reads))
+	require.False(t, r.HasFile(up))
+}
+
+func TestExpiredFile(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "resizer")
+	require.NoError(t, err)
+	defer os.RemoveAll(cacheDir)
+
+	cfg := config.GetDefaultConfig()
+	cfg.CacheDir = cacheDir
+	cfg.CacheTTL = 50 * time.Millisecond
+	r, err := New(cfg)
+	require.NoError(t, err)
+	defer r.Close()
+
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "orientation_1.jpg"))
+	require.NoError(t, err)
+	up := utils.URLParams{Method: "fill", Width: 30, Height: 30}
+	require.NoError(t, r.ResizeAndSave(context.Background(), bytes.NewReader(data), up, "image/jpeg"))
+	require.True(t, r.HasFile(up))
+
+	time.Sleep(60 * time.Millisecond)
+	require.False(t, r.HasFile(up))
+}
+
+func TestMemoryCache(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "resizer")
+	require.NoError(t, err)
+	defer os.RemoveAll(cacheDir)
+
+	cfg := config.GetDefaultConfig()
+	cfg.CacheDir = cacheDir
+	r, err := New(cfg)
+	require.NoError(t, err)
+
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "orientation_1.jpg"))
+	require.NoError(t, err)
+	up := utils.URLParams{Method: "fill", Width: 30, Height: 30}
+	require.NoError(t, r.ResizeAndSave(context.Background(), bytes.NewReader(data), up, "image/jpeg"))
+
+	// File is promoted on the first access
+	fd, _, err := r.Open(up)
+	require.NoError(t, err)
+	expected, err := ioutil.ReadAll(fd)
+	fd.Close()
+	require.NoError(t, err)
+	result, mimeType, found := r.GetBytes(up)
+	require.True(t, found)
+	require.Equal(t, "image/jpeg", mimeType)
+	require.Equal(t, expected, result)
+
+	// Disk isn't accessed anymore
+	key := string(r.GetCacheKey(up))
+	require.NoError(t, os.Remove(filepath.Join(cacheDir, key[0:2], key[2:4], key)))
+	require.True(t, r.HasFile(up))
+	result, _, found = r.GetBytes(up)
+	require.True(t, found)
+	require.Equal(t, expected, result)
+
+	// New version of the file replaces the one in memory
+	r.hot.Set(r.GetCacheKey(up), cache.Entry{Data: []byte("stale"), ContentType: "image/jpeg"})
+	require.NoError(t, r.ResizeAndSave(context.Background(), bytes.NewReader(data), up, "image/jpeg"))
+	result, _, found = r.GetBytes(up)
+	require.True(t, found)
+	require.Equal(t, expected, result)
+}
+
+func TestCacheBackends(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+
+	cfg := config.GetDefaultConfig()
+	cfg.CacheBackend = "redis"
+	cfg.RedisAddress = s.Addr()
+	r, err := New(cfg)
+	require.NoError(t, err)
+	defer r.Close()
+
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "orientation_1.jpg"))
+	require.NoError(t, err)
+	up := utils.URLParams{Method: "fill", Width: 30, Height: 30}
+	require.False(t, r.HasFile(up))
+	require.NoError(t, r.ResizeAndSave(context.Background(), bytes.NewReader(data), up, "image/jpeg"))
+	require.True(t, r.HasFile(up))
+	require.True(t, s.Exists(cfg.RedisPrefix+string(r.GetCacheKey(up))))
+
+	content, meta, err := r.Open(up)
+	require.NoError(t, err)
+	defer content.Close()
+	require.Equal(t, "image/jpeg", meta.ContentType)
+	img, err := jpeg.Decode(content)
+	require.NoError(t, err)
+	require.Equal(t, image.Rect(0, 0, 30, 30), img.Bounds())
+
+	cfg.CacheBackend = "unknown"
+	_, err = New(cfg)
+	require.True(t, errors.Is(err, ErrUnknownCacheBackend))
+}
+
+func TestSharedMemoryCache(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+
+	cfg := config.GetDefaultConfig()
+	cfg.CacheBackend = "redis"
+	cfg.RedisAddress = s.Addr()
+	cfg.CacheTTL = 50 * time.Millisecond
+	r1, err := New(cfg)
+	require.NoError(t, err)
+	defer r1.Close()
+	r2, err := New(cfg)
+	require.NoError(t, err)
+	defer r2.Close()
+
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "orientation_1.jpg"))
+	require.NoError(t, err)
+	up := utils.URLParams{Method: "fill", Width: 30, Height: 30}
+	require.NoError(t, r1.ResizeAndSave(context.Background(), bytes.NewReader(data), up, "image/jpeg"))
+	old, _, found := r1.GetBytes(up)
+	require.True(t, found)
+
+	// File is resized again by another instance, memory of the first one expires with TTL
+	data, err = ioutil.ReadFile(filepath.Join("testdata", "orientation_6.jpg"))
+	require.NoError(t, err)
+	require.NoError(t, r2.ResizeAndSave(context.Background(), bytes.NewReader(data), up, "image/jpeg"))
+	result, _, found := r1.GetBytes(up)
+	require.True(t, found)
+	require.Equal(t, old, result)
+	time.Sleep(60 * time.Millisecond)
+	result, _, found = r1.GetBytes(up)
+	require.True(t, found)
+	require.NotEqual(t, old, result)
+}
+
+func TestValidate(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "resizer")
+	require.NoError(t, err)
+	defer os.RemoveAll(cacheDir)
+
+	cfg := config.GetDefaultConfig()
+	cfg.CacheDir = cacheDir
+	cfg.MinQuality = 30
+	cfg.MaxQuality = 90
+	cfg.MinCompression = 3
+	r, err := New(cfg)
+	require.NoError(t, err)
+	defer r.Close()
+
+	low, high := 1, 9
+	require.NoError(t, r.Validate(utils.URLParams{Quality: 50, Compression: &high}))
+	require.NoError(t, r.Validate(utils.URLParams{}))
+	require.True(t, errors.Is(r.Validate(utils.URLParams{Quality: 20}), ErrOptionOutOfRange))
+	require.True(t, errors.Is(r.Validate(utils.URLParams{Quality: 95}), ErrOptionOutOfRange))
+	require.True(t, errors.Is(r.Validate(utils.URLParams{Compression: &low}), ErrOptionOutOfRange))
+}
+
+func TestCacheKeyOptions(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "resizer")
+	require.NoError(t, err)
+	defer os.RemoveAll(cacheDir)
+
+	cfg := config.GetDefaultConfig()
+	cfg.CacheDir = cacheDir
+	r, err := New(cfg)
+	require.NoError(t, err)
+	defer r.Close()
+
+	compression, compression2 := 1, 2
+	key := func(format string, quality int, compression *int) cache.Key {
+		return r.GetCacheKey(utils.URLParams{
+			Method: "fit", Width: 30, Height: 30, ExternalURL: "example.com/image.jpg",
+			Format: format, Quality: quality, Compression: compression,
+		})
+	}
+	// Options, which are not used by the output format, don't change the key
+	require.Equal(t, key("jpeg", 80, nil), key("jpeg", 80, &compression))
+	require.NotEqual(t, key("jpeg", 80, nil), key("jpeg", 70, nil))
+	require.Equal(t, key("png", 80, nil), key("png", 70, nil))
+	require.NotEqual(t, key("png", 0, nil), key("png", 0, &compression))
+	// Compression levels, which give the same output, share the key
+	require.Equal(t, key("png", 0, &compression), key("png", 0, &compression2))
+	require.Equal(t, key("gif", 80, nil), key("gif", 70, &compression))
+	// Output format isn't known, so both options are used
+	require.NotEqual(t, key("", 80, nil), key("", 70, nil))
+	require.NotEqual(t, key("", 0, nil), key("", 0, &compression))
+}
@@ -0,0 +1,98 @@
+package resizer
+
+import (
+	"image"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+// Size of the downscaled copy of the image, which is used for the analysis.
+const smartCropAnalysisSize = 256
+
+// smartCrop finds the crop window with the aspect ratio of width/height, which contains the most details.
+// Details are measured as the entropy of the luminance histogram of the window.
+func smartCrop(img image.Image, width, height int) image.Rectangle {
+	bounds := img.Bounds()
+	cropWidth, cropHeight := cropSize(bounds, width, height)
+	if cropWidth == bounds.Dx() && cropHeight == bounds.Dy() {
+		return bounds
+	}
+	// Only one dimension can be cropped, the other one is used completely
+	horizontal := cropWidth < bounds.Dx()
+
+	analysis := imaging.Fit(img, smartCropAnalysisSize, smartCropAnalysisSize, imaging.Box)
+	analysisWidth, analysisHeight := analysis.Bounds().Dx(), analysis.Bounds().Dy()
+	ratio := float64(analysisWidth) / float64(bounds.Dx())
+
+	// Luminance histogram of every column (horizontal crop) or row (vertical crop)
+	lines, window := analysisHeight, clamp(int(math.Round(float64(cropHeight)*ratio)), 1, analysisHeight)
+	if horizontal {
+		lines, window = analysisWidth, clamp(int(math.Round(float64(cropWidth)*ratio)), 1, analysisWidth)
+	}
+	histograms := make([][256]int, lines)
+	for y := 0; y < analysisHeight; y++ {
+		for x := 0; x < analysisWidth; x++ {
+			i := analysis.PixOffset(x, y)
+			r, g, b := int(analysis.Pix[i]), int(analysis.Pix[i+1]), int(analysis.Pix[i+2])
+			lum := (299*r + 587*g + 114*b) / 1000
+			if horizontal {
+				histograms[x][lum]++
+			} else {
+				histograms[y][lum]++
+			}
+		}
+	}
+
+	// Slide the window and keep the histogram of the current position up to date
+	var hist [256]int
+	for i := 0; i < window; i++ {
+		addHistogram(&hist, &histograms[i], 1)
+	}
+	center := (lines - window) / 2
+	best, bestScore := 0, entropy(&hist)
+	for i := 1; i+window <= lines; i++ {
+		addHistogram(&hist, &histograms[i-1], -1)
+		addHistogram(&hist, &histograms[i+window-1], 1)
+		score := entropy(&hist)
+		// Prefer the window closer to the center, if scores are equal
+		if score > bestScore || (score == bestScore && abs(i-center) < abs(best-center)) {
+			best, bestScore = i, score
+		}
+	}
+
+	offset := int(math.Round(float64(best) / ratio))
+	if horizontal {
+		x := bounds.Min.X + clamp(offset, 0, bounds.Dx()-cropWidth)
+
+		return image.Rect(x, bounds.Min.Y, x+cropWidth, bounds.Max.Y)
+	}
+	y := bounds.Min.Y + clamp(offset, 0, bounds.Dy()-cropHeight)
+
+	return image.Rect(bounds.Min.X, y, bounds.Max.X, y+cropHeight)
+}
+
+func addHistogram(dst, src *[256]int, sign int) {
+	for i := range dst {
+		dst[i] += sign * src[i]
+	}
+}
+
+func entropy(hist *[256]int) (result float64) {
+	total := 0
+	for _, v := range hist {
+		total += v
+	}
+	if total == 0 {
+		return
+	}
+	for _, v := range hist {
+		if v == 0 {
+			continue
+		}
+		p := float64(v) / float64(total)
+		result -= p * math.Log2(p)
+	}
+
+	return
+}
@@ -0,0 +1,86 @@
+package signer
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+
+	"github.com/dmitryt/image-previewer/internal/config"
+)
+
+const unsafePrefix = "unsafe"
+
+var (
+	ErrMissingSignature = errors.New("URL signature is missing")
+	ErrInvalidSignature = errors.New("URL signature is invalid")
+)
+
+// Signer verifies URLs in format /<signature>/<method>/<width>/<height>/<external url>,
+// where signature is base64url encoded HMAC-SHA256 of the rest of the path.
+type Signer struct {
+	keys        [][]byte
+	allowUnsafe bool
+}
+
+func New(cfg *config.Config) *Signer {
+	keys := make([][]byte, 0, len(cfg.SignatureKeys))
+	for _, key := range cfg.SignatureKeys {
+		if key != "" {
+			keys = append(keys, []byte(key))
+		}
+	}
+
+	return &Signer{keys: keys, allowUnsafe: cfg.AllowUnsafe}
+}
+
+// Enabled - signature is required only if at least one key is set.
+func (s *Signer) Enabled() bool {
+	return len(s.keys) > 0
+}
+
+// Sign returns the signature of the path, calculated with the key.
+func Sign(key, path string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	_, _ = mac.Write([]byte(path))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the signature of the path and returns the path without it.
+// Any of the keys can be used for the signature, so keys can be rotated.
+func (s *Signer) Verify(path string) (string, error) {
+	parts := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)
+	if len(parts) < 2 {
+		if s.Enabled() {
+			return path, ErrMissingSignature
+		}
+
+		return path, nil
+	}
+	signature, rest := parts[0], "/"+parts[1]
+	if signature == unsafePrefix {
+		if s.Enabled() && !s.allowUnsafe {
+			return path, ErrMissingSignature
+		}
+
+		return rest, nil
+	}
+	if !s.Enabled() {
+		return path, nil
+	}
+	actual, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return path, ErrInvalidSignature
+	}
+	for _, key := range s.keys {
+		mac := hmac.New(sha256.New, key)
+		_, _ = mac.Write([]byte(rest))
+		if hmac.Equal(actual, mac.Sum(nil)) {
+			return rest, nil
+		}
+	}
+
+	return path, ErrInvalidSignature
+}
@@ -0,0 +1,62 @@
+package signer
+
+import (
+	"testing"
+
+	"github.com/dmitryt/image-previewer/internal/config"
+	"github.com/stretchr/testify/require"
+)
+
+func newSigner(keys []string, allowUnsafe bool) *Signer {
+	cfg := config.GetDefaultConfig()
+	cfg.SignatureKeys = keys
+	cfg.AllowUnsafe = allowUnsafe
+
+	return New(cfg)
+}
+
+func TestVerify(t *testing.T) {
+	path := "/fill/300/200/www.audubon.org/sites/default/files/owl.jpg"
+
+	t.Run("should accept any URL, if keys are not set", func(t *testing.T) {
+		s := newSigner(nil, false)
+		for url, expected := range map[string]string{
+			path:             path,
+			"/unsafe" + path: path,
+		} {
+			result, err := s.Verify(url)
+			require.NoError(t, err)
+			require.Equal(t, expected, result)
+		}
+	})
+
+	t.Run("should accept URL signed with any of the keys", func(t *testing.T) {
+		s := newSigner([]string{"new-secret", "old-secret"}, false)
+		for _, key := range []string{"new-secret", "old-secret"} {
+			result, err := s.Verify("/" + Sign(key, path) + path)
+			require.NoError(t, err)
+			require.Equal(t, path, result)
+		}
+	})
+
+	t.Run("should reject invalid signatures", func(t *testing.T) {
+		s := newSigner([]string{"secret"}, false)
+		for _, url := range []string{
+			"/" + Sign("another-secret", path) + path,
+			"/" + Sign("secret", path) + "/fill/3000/2000/www.audubon.org/sites/default/files/owl.jpg",
+			"/not-base64!" + path,
+		} {
+			_, err := s.Verify(url)
+			require.Equal(t, ErrInvalidSignature, err, url)
+		}
+	})
+
+	t.Run("should accept unsafe URLs only if it's allowed", func(t *testing.T) {
+		_, err := newSigner([]string{"secret"}, false).Verify("/unsafe" + path)
+		require.Equal(t, ErrMissingSignature, err)
+
+		result, err := newSigner([]string{"secret"}, true).Verify("/unsafe" + path)
+		require.NoError(t, err)
+		require.Equal(t, path, result)
+	})
+}
@@ -0,0 +1,67 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/dmitryt/image-previewer/internal/cache"
+)
+
+// Result of receiving the file, which is shared between all callers with the same key.
+type result struct {
+	statusCode int
+	content    string
+	err        error
+}
+
+type call struct {
+	// Closed, when the result is ready
+	done   chan struct{}
+	result result
+}
+
+// flightGroup collapses concurrent calls with the same key into the single one.
+// The first caller (leader) does the work, others wait for it and get the same result.
+type flightGroup struct {
+	calls map[cache.Key]*call
+	mux   sync.Mutex
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{calls: make(map[cache.Key]*call)}
+}
+
+// Do executes fn, unless the call with the same key is already in flight. In that case it waits
+// for the call to be finished or for ctx to be done. shared reports, whether the result was received
+// from another caller.
+func (g *flightGroup) Do(ctx context.Context, key cache.Key, fn func() result) (res result, shared bool) {
+	g.mux.Lock()
+	if c, ok := g.calls[key]; ok {
+		g.mux.Unlock()
+		select {
+		case <-c.done:
+			return c.result, true
+		case <-ctx.Done():
+			return result{
+				statusCode: http.StatusGatewayTimeout,
+				content:    fmt.Sprintf("%s", ctx.Err()),
+				err:        ctx.Err(),
+			}, true
+		}
+	}
+	c := &call{done: make(chan struct{})}
+	g.calls[key] = c
+	g.mux.Unlock()
+
+	defer func() {
+		g.mux.Lock()
+		delete(g.calls, key)
+		g.mux.Unlock()
+		close(c.done)
+	}()
+	c.result = fn()
+
+	return c.result, false
+}
@@ -1,6 +1,7 @@
 package transport
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -18,29 +19,68 @@ var ErrResize = errors.New("resize problem occurred")
 type Transport struct {
 	fetcher fetcher.Fetcher
 	resizer *resizer.Resizer
+	flights *flightGroup
 }
 
 func New(f fetcher.Fetcher, r *resizer.Resizer) *Transport {
 	return &Transport{
 		fetcher: f,
 		resizer: r,
+		flights: newFlightGroup(),
 	}
 }
 
-func (t *Transport) Receive(urlParams utils.URLParams, header http.Header) (statusCode int, content string, err error) {
+// Receive makes sure, that the resized file is in cache, fetching and resizing it if it's needed.
+// Concurrent requests for the same file are collapsed, so the file is fetched and written once,
+// other requests wait for it to be finished.
+func (t *Transport) Receive(ctx context.Context, urlParams utils.URLParams, header http.Header) (statusCode int, content string, err error) {
+	// Cached files are checked without waiting for the files in flight
+	if t.resizer.HasFile(urlParams) {
+		return http.StatusOK, "", nil
+	}
+	cacheKey := t.resizer.GetCacheKey(urlParams)
+	for {
+		res, shared := t.flights.Do(ctx, cacheKey, func() result {
+			// The file could be written by the previous leader, while this one was waiting
+			if t.resizer.HasFile(urlParams) {
+				return result{statusCode: http.StatusOK}
+			}
+			log.Debug().Msg("File was not found in cache, fetching the content...")
+			statusCode, content, err := t.receive(ctx, urlParams, header)
+
+			return result{statusCode: statusCode, content: content, err: err}
+		})
+		// Leader's request was cancelled by its client, so the work should be repeated for this one
+		if shared && errors.Is(res.err, context.Canceled) && ctx.Err() == nil {
+			log.Debug().Msgf("Shared receiving was cancelled, retrying, err: %s", res.err)
+
+			continue
+		}
+
+		return res.statusCode, res.content, res.err
+	}
+}
+
+func (t *Transport) receive(ctx context.Context, urlParams utils.URLParams, header http.Header) (statusCode int, content string, err error) {
 	pipeReader, pipeWriter := io.Pipe()
-	statusCode, content, mimeType, err := t.fetcher.Fetch(urlParams.ExternalURL, header, pipeWriter)
+	// Fetcher stops writing the content, if resizing is finished before reading all of it
+	defer pipeReader.Close()
+	statusCode, content, mimeType, err := t.fetcher.Fetch(ctx, urlParams.ExternalURL, header, pipeWriter)
 	if err != nil {
 		return
 	}
 	log.Debug().Msgf("File was fetched statusCode:%d err:%s", statusCode, err)
 	// Resize and save to cache
-	err = t.resizer.ResizeAndSave(pipeReader, urlParams, mimeType)
+	err = t.resizer.ResizeAndSave(ctx, pipeReader, urlParams, mimeType)
 	if err != nil {
 		statusCode = 400
 		content = fmt.Sprintf("%s", ErrResize)
-		if errors.Is(err, resizer.ErrUnsupportedFileType) {
+		switch {
+		case errors.Is(err, resizer.ErrUnsupportedFileType):
 			content = fmt.Sprintf("%s", err)
+		case errors.Is(err, context.DeadlineExceeded):
+			statusCode = http.StatusGatewayTimeout
+			content = fmt.Sprintf("%s: %s", ErrResize, err)
 		}
 	}
 
@@ -48,23 +88,26 @@ func (t *Transport) Receive(urlParams utils.URLParams, header http.Header) (stat
 }
 
 func (t *Transport) Send(urlParams utils.URLParams, w http.ResponseWriter) (err error) {
-	cacheFile, contentType, err := t.resizer.GetFile(urlParams)
-	log.Debug().Msgf("Received file contentType: %s, err: %s", contentType, err)
-	if err != nil {
+	// Small popular files are served from memory
+	if data, contentType, found := t.resizer.GetBytes(urlParams); found {
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		_, err = w.Write(data)
+
 		return
 	}
-	defer cacheFile.Close()
-	fileInfo, err := cacheFile.Stat()
-	log.Debug().Msgf("Getting file info %+v, err: %s", fileInfo, err)
+	content, meta, err := t.resizer.Open(urlParams)
+	log.Debug().Msgf("Received file meta: %+v, err: %s", meta, err)
 	if err != nil {
 		return
 	}
+	defer content.Close()
 
 	// Send the headers
-	w.Header().Set("Content-Type", contentType)
-	w.Header().Set("Content-Length", strconv.FormatInt(fileInfo.Size(), 10)) // Get file size as a string
+	w.Header().Set("Content-Type", meta.ContentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(meta.Size, 10))
 
-	_, err = io.Copy(w, cacheFile)
+	_, err = io.Copy(w, content)
 
 	return
 }
@@ -0,0 +1,140 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dmitryt/image-previewer/internal/config"
+	"github.com/dmitryt/image-previewer/internal/resizer"
+	"github.com/dmitryt/image-previewer/internal/utils"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var cacheDir = ".cache"
+
+func init() {
+	zerolog.SetGlobalLevel(zerolog.InfoLevel)
+}
+
+// Fetcher, which counts the calls and writes the same image with a delay.
+type countingFetcher struct {
+	calls int32
+	data  []byte
+}
+
+func (f *countingFetcher) Fetch(ctx context.Context, url string, header http.Header, w io.Writer) (int, string, string, error) {
+	atomic.AddInt32(&f.calls, 1)
+	go func() {
+		// Give the concurrent requests a chance to come, while the file is fetched
+		time.Sleep(100 * time.Millisecond)
+		_, err := io.Copy(w, bytes.NewReader(f.data))
+		if pw, ok := w.(*io.PipeWriter); ok {
+			pw.CloseWithError(err)
+		}
+	}()
+
+	return http.StatusOK, "", "image/png", nil
+}
+
+func pngImage(t *testing.T) []byte {
+	img := image.NewNRGBA(image.Rect(0, 0, 200, 100))
+	for x := 0; x < 200; x++ {
+		for y := 0; y < 100; y++ {
+			img.Set(x, y, color.NRGBA{R: uint8(x), G: uint8(y), B: 100, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	require.NoError(t, png.Encode(&buf, img))
+
+	return buf.Bytes()
+}
+
+func TestConcurrentReceive(t *testing.T) {
+	defer os.RemoveAll(cacheDir)
+	cfg := config.GetDefaultConfig()
+	cfg.CacheDir = cacheDir
+	rsz, err := resizer.New(cfg)
+	require.NoError(t, err)
+	data := pngImage(t)
+	f := &countingFetcher{data: data}
+	tr := New(f, rsz)
+
+	urlParams := utils.ParseURL("/fill/50/50/example.com/image.png")
+	require.NoError(t, urlParams.Error)
+
+	requests := 20
+	var wg sync.WaitGroup
+	wg.Add(requests)
+	bodies := make([][]byte, requests)
+	for i := 0; i < requests; i++ {
+		go func(i int) {
+			defer wg.Done()
+			statusCode, content, err := tr.Receive(context.Background(), urlParams, http.Header{})
+			assert.NoError(t, err)
+			assert.Equal(t, http.StatusOK, statusCode, content)
+			rec := httptest.NewRecorder()
+			assert.NoError(t, tr.Send(urlParams, rec))
+			bodies[i] = rec.Body.Bytes()
+		}(i)
+	}
+	wg.Wait()
+
+	require.Equal(t, int32(1), atomic.LoadInt32(&f.calls))
+	img, err := png.Decode(bytes.NewReader(bodies[0]))
+	require.NoError(t, err)
+	require.Equal(t, image.Rect(0, 0, 50, 50), img.Bounds())
+	for _, body := range bodies[1:] {
+		require.Equal(t, bodies[0], body)
+	}
+
+	// File is taken from cache, when nothing is in flight
+	statusCode, _, err := tr.Receive(context.Background(), urlParams, http.Header{})
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, statusCode)
+	require.Equal(t, int32(1), atomic.LoadInt32(&f.calls))
+}
+
+func TestCancelledFollower(t *testing.T) {
+	defer os.RemoveAll(cacheDir)
+	cfg := config.GetDefaultConfig()
+	cfg.CacheDir = cacheDir
+	rsz, err := resizer.New(cfg)
+	require.NoError(t, err)
+	f := &countingFetcher{data: pngImage(t)}
+	tr := New(f, rsz)
+
+	urlParams := utils.ParseURL("/fill/60/60/example.com/image.png")
+	require.NoError(t, urlParams.Error)
+
+	leader := make(chan error, 1)
+	go func() {
+		_, _, err := tr.Receive(context.Background(), urlParams, http.Header{})
+		leader <- err
+	}()
+	// Leader fetches the file for 100ms, follower stops waiting earlier
+	time.Sleep(20 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	started := time.Now()
+	statusCode, _, err := tr.Receive(ctx, urlParams, http.Header{})
+	require.True(t, errors.Is(err, context.DeadlineExceeded))
+	require.Equal(t, http.StatusGatewayTimeout, statusCode)
+	require.Less(t, int64(time.Since(started)), int64(60*time.Millisecond))
+
+	require.NoError(t, <-leader)
+	require.Equal(t, int32(1), atomic.LoadInt32(&f.calls))
+}
@@ -0,0 +1,28 @@
+package utils
+
+import "strings"
+
+// MatchHost checks, whether host matches the pattern.
+// Pattern can be the exact host name, "*" for any host or "*.example.com" for all subdomains.
+func MatchHost(pattern, host string) bool {
+	pattern, host = strings.ToLower(pattern), strings.ToLower(host)
+	switch {
+	case pattern == "*":
+		return true
+	case strings.HasPrefix(pattern, "*."):
+		return strings.HasSuffix(host, pattern[1:])
+	default:
+		return pattern == host
+	}
+}
+
+// MatchAnyHost checks, whether host matches any of the patterns.
+func MatchAnyHost(patterns []string, host string) bool {
+	for _, pattern := range patterns {
+		if MatchHost(pattern, host) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,27 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatchHost(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		host     string
+		expected bool
+	}{
+		{pattern: "example.com", host: "example.com", expected: true},
+		{pattern: "example.com", host: "EXAMPLE.com", expected: true},
+		{pattern: "example.com", host: "cdn.example.com", expected: false},
+		{pattern: "*.example.com", host: "cdn.example.com", expected: true},
+		{pattern: "*.example.com", host: "a.cdn.example.com", expected: true},
+		{pattern: "*.example.com", host: "example.com", expected: false},
+		{pattern: "*.example.com", host: "badexample.com", expected: false},
+		{pattern: "*", host: "anything", expected: true},
+	}
+	for _, tc := range tests {
+		require.Equal(t, tc.expected, MatchHost(tc.pattern, tc.host), "%s %s", tc.pattern, tc.host)
+	}
+}
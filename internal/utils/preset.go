@@ -0,0 +1,97 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	ErrInvalidPreset = errors.New("invalid preset")
+	ErrUnknownPreset = errors.New("unknown preset")
+)
+
+var (
+	presetURLRe  = regexp.MustCompile(`^/preset/([^/]+)/(.*)$`)
+	presetSizeRe = regexp.MustCompile(`^(\d+)x(\d+)$`)
+)
+
+// Short names of options, which can be used in presets.
+var presetAliases = map[string]string{
+	"q": "quality",
+}
+
+// ParsePreset parses preset definition like "fill 150x150 q=70 gravity=smart".
+// Options are the same as in URL, they are set as <name>=<value>.
+func ParsePreset(definition string) (URLParams, error) {
+	fields := strings.Fields(definition)
+	if len(fields) < 2 {
+		return URLParams{}, fmt.Errorf("%w: %s", ErrInvalidPreset, definition)
+	}
+	size := presetSizeRe.FindStringSubmatch(fields[1])
+	if size == nil {
+		return URLParams{}, fmt.Errorf("%w: %s", ErrInvalidPreset, definition)
+	}
+	url := fmt.Sprintf("/%s/%s/%s/", fields[0], size[1], size[2])
+	for _, option := range fields[2:] {
+		parts := strings.SplitN(option, "=", 2)
+		if len(parts) != 2 {
+			return URLParams{}, fmt.Errorf("%w: %s", ErrInvalidPreset, definition)
+		}
+		name := parts[0]
+		if alias, ok := presetAliases[name]; ok {
+			name = alias
+		}
+		url += name + ":" + parts[1] + "/"
+	}
+	result := ParseURL(url)
+	if result.Error != nil {
+		return URLParams{}, fmt.Errorf("%w: %s: %s", ErrInvalidPreset, definition, result.Error)
+	}
+	// Options which are not recognized are left in the external url
+	if result.ExternalURL != "" {
+		return URLParams{}, fmt.Errorf("%w: %s: unknown option %s", ErrInvalidPreset, definition, result.ExternalURL)
+	}
+
+	return result, nil
+}
+
+// ParsePresets parses all preset definitions from config.
+func ParsePresets(definitions map[string]string) (map[string]URLParams, error) {
+	result := make(map[string]URLParams, len(definitions))
+	for name, definition := range definitions {
+		up, err := ParsePreset(definition)
+		if err != nil {
+			return nil, fmt.Errorf("preset %s: %w", name, err)
+		}
+		result[name] = up
+	}
+
+	return result, nil
+}
+
+// IsPresetURL checks, whether URL has format /preset/<name>/<external url>.
+func IsPresetURL(url string) bool {
+	return presetURLRe.MatchString(url)
+}
+
+// ParsePresetURL parses URL in format /preset/<name>/<external url>.
+func ParsePresetURL(url string, presets map[string]URLParams) URLParams {
+	matched := presetURLRe.FindStringSubmatch(url)
+	if matched == nil {
+		return URLParams{Error: ErrURLPatternMatching}
+	}
+	result, ok := presets[matched[1]]
+	if !ok {
+		return URLParams{Error: fmt.Errorf("%w %s", ErrUnknownPreset, matched[1])}
+	}
+	externalURL, filename, err := parseExternalURL(matched[2])
+	if err != nil {
+		return URLParams{Error: err}
+	}
+	result.Filename = filename
+	result.ExternalURL = externalURL
+
+	return result
+}
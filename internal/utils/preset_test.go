@@ -0,0 +1,60 @@
+package utils
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePreset(t *testing.T) {
+	t.Run("should parse preset definition", func(t *testing.T) {
+		result, err := ParsePreset("fill 150x150 q=70 gravity=smart")
+		require.NoError(t, err)
+		require.Equal(t, URLParams{
+			Method:  "fill",
+			Width:   150,
+			Height:  150,
+			Quality: 70,
+			Gravity: "smart",
+		}, result)
+	})
+
+	t.Run("should return an error for invalid definitions", func(t *testing.T) {
+		for _, definition := range []string{
+			"",
+			"fill",
+			"fill 150",
+			"crop 150x150",
+			"fill 150x150 q=170",
+			"fill 150x150 unknown=1",
+			"fill 150x150 gravity",
+		} {
+			_, err := ParsePreset(definition)
+			require.True(t, errors.Is(err, ErrInvalidPreset), definition)
+		}
+	})
+}
+
+func TestParsePresetURL(t *testing.T) {
+	presets, err := ParsePresets(map[string]string{"thumb": "fit 150x100"})
+	require.NoError(t, err)
+
+	t.Run("should parse preset URL", func(t *testing.T) {
+		result := ParsePresetURL("/preset/thumb/www.audubon.org/sites/default/files/owl.jpg", presets)
+		require.Equal(t, URLParams{
+			Method:      "fit",
+			Width:       150,
+			Height:      100,
+			Filename:    "owl.jpg",
+			ExternalURL: "www.audubon.org/sites/default/files/owl.jpg",
+		}, result)
+		require.True(t, IsPresetURL("/preset/thumb/www.audubon.org/sites/default/files/owl.jpg"))
+	})
+
+	t.Run("should return an error for unknown preset", func(t *testing.T) {
+		result := ParsePresetURL("/preset/banner/www.audubon.org/sites/default/files/owl.jpg", presets)
+		require.True(t, errors.Is(result.Error, ErrUnknownPreset))
+		require.False(t, IsPresetURL("/fill/100/100/www.audubon.org/sites/default/files/owl.jpg"))
+	})
+}
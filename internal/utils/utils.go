@@ -1,8 +1,11 @@
 package utils
 
 import (
+	"encoding/base64"
 	"errors"
+	"fmt"
 	"net/http"
+	"net/url"
 	"os"
 	"regexp"
 	"strconv"
@@ -12,41 +15,236 @@ import (
 )
 
 type URLParams struct {
-	Method      string
-	Height      int
-	Width       int
-	Filename    string
-	ExternalURL string
-	Error       error
+	Method       string
+	Height       int
+	Width        int
+	Gravity      string
+	FocusX       float64
+	FocusY       float64
+	Format       string
+	AcceptFormat string // preferred by the client, used when Format isn't set
+	Quality      int
+	Compression  *int
+	FirstFrame   bool
+	Metadata     string
+	Filename     string
+	ExternalURL  string
+	Error        error
 }
 
-var ErrURLPatternMatching = errors.New("URL doesn't match the pattern")
+var (
+	ErrURLPatternMatching = errors.New("URL doesn't match the pattern")
+	ErrZeroDimensions     = errors.New("width and height cannot be both 0")
+	ErrInvalidOption      = errors.New("invalid option value")
+	ErrInvalidExternalURL = errors.New("invalid external url")
+	ErrFillOnlyOption     = errors.New("option is supported only by fill method")
+)
+
+const base64Prefix = "b64:"
+
+var (
+	urlRe    = regexp.MustCompile(`/(fill|fit|resize)/(\d+)/(\d+)/(.*)?`)
+	optionRe = regexp.MustCompile(`^(gravity|focus|format|quality|compression|frame|metadata):([^/]*)/`)
+	focusRe  = regexp.MustCompile(`^(\d+(?:\.\d+)?):(\d+(?:\.\d+)?)$`)
+	// Scheme of the external url
+	schemeRe        = regexp.MustCompile(`^(?i)(https?):/+`)
+	encodedSchemeRe = regexp.MustCompile(`^(?i)https?%3A`)
+)
+
+// Gravities - supported crop anchors for the fill method.
+var Gravities = map[string]bool{
+	"center":      true,
+	"top":         true,
+	"bottom":      true,
+	"left":        true,
+	"right":       true,
+	"topleft":     true,
+	"topright":    true,
+	"bottomleft":  true,
+	"bottomright": true,
+	"smart":       true,
+}
+
+// Formats - supported output formats and their content types.
+var Formats = map[string]string{
+	"jpeg": "image/jpeg",
+	"png":  "image/png",
+	"gif":  "image/gif",
+	"webp": "image/webp",
+}
+
+// Formats, which are picked by the Accept header, in the order of preference.
+var negotiableFormats = []string{"webp"}
 
-var urlRe = regexp.MustCompile(`/fill/(\d+)/(\d+)/(.*)?`)
+// NegotiateFormat returns the preferred output format, advertised in the Accept header.
+// Empty string means that the format of the original image should be kept.
+func NegotiateFormat(accept string) string {
+	accepted := make(map[string]bool)
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(params[0]))
+		quality := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(param[2:], 64)
+				if err == nil {
+					quality = q
+				}
+			}
+		}
+		accepted[mediaType] = quality > 0
+	}
+	for _, format := range negotiableFormats {
+		if accepted[Formats[format]] {
+			return format
+		}
+	}
+
+	return ""
+}
+
+// Focal point is set in percents of the image size, e.g. focus:30:70.
+func parseFocus(up *URLParams, value string) bool {
+	matched := focusRe.FindStringSubmatch(value)
+	if matched == nil {
+		return false
+	}
+	x, errX := strconv.ParseFloat(matched[1], 64)
+	y, errY := strconv.ParseFloat(matched[2], 64)
+	if errX != nil || errY != nil || x > 100 || y > 100 {
+		return false
+	}
+	up.Gravity = "focus"
+	up.FocusX = x
+	up.FocusY = y
+
+	return true
+}
+
+// Parses integer option value and checks, that it's in the range.
+func parseInt(value string, min, max int) (int, bool) {
+	result, err := strconv.Atoi(value)
+	if err != nil || result < min || result > max {
+		return 0, false
+	}
+
+	return result, true
+}
+
+// Options are placed between the size and the external url, e.g. /fill/300/200/gravity:top/<external url>.
+func parseOptions(up *URLParams, url string) (string, error) {
+	for {
+		matched := optionRe.FindStringSubmatch(url)
+		if matched == nil {
+			return url, nil
+		}
+		name, value := matched[1], matched[2]
+		valid := true
+		switch name {
+		case "gravity", "focus":
+			if up.Method != "fill" {
+				return url, fmt.Errorf("%w %s:%s", ErrFillOnlyOption, name, value)
+			}
+		}
+		switch name {
+		case "gravity":
+			valid = Gravities[value]
+			up.Gravity = value
+		case "focus":
+			valid = parseFocus(up, value)
+		case "format":
+			if value == "jpg" {
+				value = "jpeg"
+			}
+			_, valid = Formats[value]
+			up.Format = value
+		case "quality":
+			up.Quality, valid = parseInt(value, 1, 100)
+		case "compression":
+			var compression int
+			compression, valid = parseInt(value, 0, 9)
+			up.Compression = &compression
+		case "frame":
+			// Only the first frame of animation is supported for now
+			valid = value == "first"
+			up.FirstFrame = true
+		case "metadata":
+			valid = value == "strip" || value == "keep"
+			up.Metadata = value
+		}
+		if !valid {
+			return url, fmt.Errorf("%w %s:%s", ErrInvalidOption, name, value)
+		}
+		url = url[len(matched[0]):]
+	}
+}
+
+// External url can be set as:
+// - host/path?query, the scheme is chosen by config
+// - http(s)://host/path?query, double slash can be lost, because the path is cleaned by router
+// - URL-encoded http(s)%3A%2F%2Fhost%2Fpath
+// - b64:<base64url encoded url>.
+func parseExternalURL(raw string) (externalURL string, filename string, err error) {
+	switch {
+	case strings.HasPrefix(raw, base64Prefix):
+		data, errDecode := base64.RawURLEncoding.DecodeString(strings.TrimRight(raw[len(base64Prefix):], "="))
+		if errDecode != nil {
+			return "", "", fmt.Errorf("%w: %s", ErrInvalidExternalURL, errDecode)
+		}
+		raw = string(data)
+	case encodedSchemeRe.MatchString(raw):
+		raw, err = url.PathUnescape(raw)
+		if err != nil {
+			return "", "", fmt.Errorf("%w: %s", ErrInvalidExternalURL, err)
+		}
+	}
+	if matched := schemeRe.FindStringSubmatch(raw); matched != nil {
+		raw = strings.ToLower(matched[1]) + "://" + raw[len(matched[0]):]
+	}
+	path := raw
+	if i := strings.IndexAny(path, "?#"); i >= 0 {
+		path = path[:i]
+	}
+	paths := strings.Split(path, "/")
+
+	return raw, paths[len(paths)-1], nil
+}
 
 func ParseURL(url string) URLParams {
 	if !urlRe.MatchString(url) {
 		return URLParams{Error: ErrURLPatternMatching}
 	}
 	matched := urlRe.FindAllStringSubmatch(url, -1)[0]
-	width, errWidth := strconv.Atoi(matched[1])
-	height, errHeight := strconv.Atoi(matched[2])
-	externalURL := matched[3]
-	paths := strings.Split(externalURL, "/")
+	width, errWidth := strconv.Atoi(matched[2])
+	height, errHeight := strconv.Atoi(matched[3])
 
 	err := errWidth
 	if err == nil {
 		err = errHeight
 	}
+	if err == nil && width == 0 && height == 0 {
+		return URLParams{Error: ErrZeroDimensions}
+	}
 
-	return URLParams{
-		Method:      "fill",
-		Width:       width,
-		Height:      height,
-		Filename:    paths[len(paths)-1],
-		ExternalURL: externalURL,
-		Error:       err,
+	result := URLParams{
+		Method: matched[1],
+		Width:  width,
+		Height: height,
+	}
+	externalURL, errOptions := parseOptions(&result, matched[4])
+	if errOptions != nil {
+		return URLParams{Error: errOptions}
 	}
+	externalURL, filename, errExternalURL := parseExternalURL(externalURL)
+	if errExternalURL != nil {
+		return URLParams{Error: errExternalURL}
+	}
+	result.Filename = filename
+	result.ExternalURL = externalURL
+	result.Error = err
+
+	return result
 }
 
 func GetFileMimeType(f *os.File) (result string, err error) {
@@ -1,6 +1,8 @@
 package utils
 
 import (
+	"encoding/base64"
+	"errors"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -20,6 +22,172 @@ func TestParseURL(t *testing.T) {
 		}, result)
 	})
 
+	t.Run("should parse fit method", func(t *testing.T) {
+		result := ParseURL("/fit/300/200/www.audubon.org/sites/default/files/owl.jpg")
+		require.Equal(t, URLParams{
+			Method:      "fit",
+			Height:      200,
+			Width:       300,
+			Filename:    "owl.jpg",
+			ExternalURL: "www.audubon.org/sites/default/files/owl.jpg",
+			Error:       nil,
+		}, result)
+	})
+
+	t.Run("should parse resize method with proportional dimension", func(t *testing.T) {
+		result := ParseURL("/resize/0/200/www.audubon.org/sites/default/files/owl.jpg")
+		require.Equal(t, URLParams{
+			Method:      "resize",
+			Height:      200,
+			Width:       0,
+			Filename:    "owl.jpg",
+			ExternalURL: "www.audubon.org/sites/default/files/owl.jpg",
+			Error:       nil,
+		}, result)
+	})
+
+	t.Run("should not allow both dimensions to be 0", func(t *testing.T) {
+		require.Equal(t, URLParams{
+			Error: ErrZeroDimensions,
+		}, ParseURL("/fill/0/0/www.audubon.org/sites/default/files/owl.jpg"))
+	})
+
+	t.Run("should parse gravity option", func(t *testing.T) {
+		result := ParseURL("/fill/300/200/gravity:topleft/www.audubon.org/sites/default/files/owl.jpg")
+		require.Equal(t, URLParams{
+			Method:      "fill",
+			Height:      200,
+			Width:       300,
+			Gravity:     "topleft",
+			Filename:    "owl.jpg",
+			ExternalURL: "www.audubon.org/sites/default/files/owl.jpg",
+			Error:       nil,
+		}, result)
+	})
+
+	t.Run("should parse focus option", func(t *testing.T) {
+		result := ParseURL("/fill/300/200/focus:25.5:70/www.audubon.org/sites/default/files/owl.jpg")
+		require.Equal(t, URLParams{
+			Method:      "fill",
+			Height:      200,
+			Width:       300,
+			Gravity:     "focus",
+			FocusX:      25.5,
+			FocusY:      70,
+			Filename:    "owl.jpg",
+			ExternalURL: "www.audubon.org/sites/default/files/owl.jpg",
+			Error:       nil,
+		}, result)
+	})
+
+	t.Run("should mark URL as invalid, if focus is out of range", func(t *testing.T) {
+		result := ParseURL("/fill/300/200/focus:120:50/www.audubon.org/sites/default/files/owl.jpg")
+		require.True(t, errors.Is(result.Error, ErrInvalidOption))
+	})
+
+	t.Run("should parse format option", func(t *testing.T) {
+		result := ParseURL("/fit/300/200/format:jpg/www.audubon.org/sites/default/files/owl.png")
+		require.Equal(t, URLParams{
+			Method:      "fit",
+			Height:      200,
+			Width:       300,
+			Format:      "jpeg",
+			Filename:    "owl.png",
+			ExternalURL: "www.audubon.org/sites/default/files/owl.png",
+			Error:       nil,
+		}, result)
+	})
+
+	t.Run("should mark URL as invalid, if format is unknown", func(t *testing.T) {
+		result := ParseURL("/fill/300/200/format:bmp/www.audubon.org/sites/default/files/owl.jpg")
+		require.True(t, errors.Is(result.Error, ErrInvalidOption))
+	})
+
+	t.Run("should parse quality and compression options", func(t *testing.T) {
+		compression := 0
+		result := ParseURL("/fill/300/200/quality:90/compression:0/www.audubon.org/sites/default/files/owl.png")
+		require.Equal(t, URLParams{
+			Method:      "fill",
+			Height:      200,
+			Width:       300,
+			Quality:     90,
+			Compression: &compression,
+			Filename:    "owl.png",
+			ExternalURL: "www.audubon.org/sites/default/files/owl.png",
+			Error:       nil,
+		}, result)
+	})
+
+	t.Run("should mark URL as invalid, if quality or compression are out of range", func(t *testing.T) {
+		for _, url := range []string{
+			"/fill/300/200/quality:0/www.audubon.org/sites/default/files/owl.jpg",
+			"/fill/300/200/quality:101/www.audubon.org/sites/default/files/owl.jpg",
+			"/fill/300/200/compression:10/www.audubon.org/sites/default/files/owl.jpg",
+		} {
+			result := ParseURL(url)
+			require.True(t, errors.Is(result.Error, ErrInvalidOption), url)
+		}
+	})
+
+	t.Run("should parse frame option", func(t *testing.T) {
+		result := ParseURL("/fill/300/200/frame:first/www.audubon.org/sites/default/files/owl.gif")
+		require.True(t, result.FirstFrame)
+		require.NoError(t, result.Error)
+		require.True(t, errors.Is(ParseURL("/fill/300/200/frame:last/example.com/owl.gif").Error, ErrInvalidOption))
+	})
+
+	t.Run("should parse metadata option", func(t *testing.T) {
+		result := ParseURL("/fill/300/200/metadata:keep/www.audubon.org/sites/default/files/owl.jpg")
+		require.Equal(t, "keep", result.Metadata)
+		require.NoError(t, result.Error)
+		require.True(t, errors.Is(ParseURL("/fill/300/200/metadata:all/example.com/owl.jpg").Error, ErrInvalidOption))
+	})
+
+	t.Run("should parse external url with scheme, port and query", func(t *testing.T) {
+		externalURL := "https://www.audubon.org:8443/files/owl.jpg?size=large&v=2"
+		for _, url := range []string{
+			"/fill/300/200/https://www.audubon.org:8443/files/owl.jpg?size=large&v=2",
+			"/fill/300/200/https:/www.audubon.org:8443/files/owl.jpg?size=large&v=2",
+			"/fill/300/200/https%3A%2F%2Fwww.audubon.org%3A8443%2Ffiles%2Fowl.jpg%3Fsize%3Dlarge%26v%3D2",
+			"/fill/300/200/b64:" + base64.RawURLEncoding.EncodeToString([]byte(externalURL)),
+		} {
+			result := ParseURL(url)
+			require.NoError(t, result.Error, url)
+			require.Equal(t, externalURL, result.ExternalURL, url)
+			require.Equal(t, "owl.jpg", result.Filename, url)
+		}
+	})
+
+	t.Run("should keep query string without scheme", func(t *testing.T) {
+		result := ParseURL("/fill/300/200/www.audubon.org/files/owl.jpg?size=large")
+		require.Equal(t, "www.audubon.org/files/owl.jpg?size=large", result.ExternalURL)
+		require.Equal(t, "owl.jpg", result.Filename)
+	})
+
+	t.Run("should mark URL as invalid, if base64 is invalid", func(t *testing.T) {
+		result := ParseURL("/fill/300/200/b64:!!!")
+		require.True(t, errors.Is(result.Error, ErrInvalidExternalURL))
+	})
+
+	t.Run("should mark URL as invalid, if gravity is unknown", func(t *testing.T) {
+		result := ParseURL("/fill/300/200/gravity:middle/www.audubon.org/sites/default/files/owl.jpg")
+		require.True(t, errors.Is(result.Error, ErrInvalidOption))
+	})
+
+	t.Run("should mark URL as invalid, if gravity is set for fit or resize", func(t *testing.T) {
+		result := ParseURL("/fit/300/200/gravity:top/www.audubon.org/sites/default/files/owl.jpg")
+		require.True(t, errors.Is(result.Error, ErrFillOnlyOption))
+		result = ParseURL("/resize/300/200/gravity:top/www.audubon.org/sites/default/files/owl.jpg")
+		require.True(t, errors.Is(result.Error, ErrFillOnlyOption))
+	})
+
+	t.Run("should mark URL as invalid, if focus is set for fit or resize", func(t *testing.T) {
+		result := ParseURL("/fit/300/200/focus:30:70/www.audubon.org/sites/default/files/owl.jpg")
+		require.True(t, errors.Is(result.Error, ErrFillOnlyOption))
+		result = ParseURL("/resize/300/200/focus:30:70/www.audubon.org/sites/default/files/owl.jpg")
+		require.True(t, errors.Is(result.Error, ErrFillOnlyOption))
+	})
+
 	t.Run("should mark URL as invalid, if URL is not matched by pattert", func(t *testing.T) {
 		require.Equal(t, URLParams{
 			Error: ErrURLPatternMatching,
@@ -29,3 +197,17 @@ func TestParseURL(t *testing.T) {
 		}, ParseURL("/something/200/300/www.audubon.org/sites/default/files/a1_1902_16_barred-owl_sandra_rothenberg_kk.jpg"))
 	})
 }
+
+func TestNegotiateFormat(t *testing.T) {
+	tests := map[string]string{
+		"":                                "",
+		"*/*":                             "",
+		"image/png,image/*;q=0.8":         "",
+		"image/avif,image/webp,*/*;q=0.8": "webp",
+		"image/webp;q=0":                  "",
+		"IMAGE/WEBP; q=0.5":               "webp",
+	}
+	for accept, expected := range tests {
+		require.Equal(t, expected, NegotiateFormat(accept), "incorrect format for %q", accept)
+	}
+}